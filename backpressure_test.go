@@ -0,0 +1,127 @@
+package jsonbarn_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/tidwall/gjson"
+)
+
+func TestBackpressure(t *testing.T) {
+	srv := newServer(t)
+	writer := connect(t, srv.Options("ann", "secret"))
+
+	subscribe := func(policy jsonbarn.Backpressure, states chan error) *jsonbarn.JsonBarn {
+		opts := srv.Options("ann", "secret")
+		opts.BufferSize = 1
+		opts.Backpressure = policy
+		opts.OnState = func(state jsonbarn.State, err error) {
+			if state == jsonbarn.StateDisconnected && states != nil {
+				select {
+				case states <- err:
+				default:
+				}
+			}
+		}
+		c := connect(t, opts)
+		if err := c.RegisterEvent("INCIDENTS"); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	level := func(m []byte) int64 {
+		return gjson.GetBytes(m, "level").Int()
+	}
+
+	t.Run("Block", func(t *testing.T) {
+		c := subscribe(jsonbarn.BackpressureBlock, nil)
+		for i := 1; i <= 3; i++ {
+			insert(t, writer, "INCIDENTS", i)
+		}
+		for i := int64(1); i <= 3; i++ {
+			if m := receive(t, c, "INSERT"); level(m) != i {
+				t.Fatal(string(m))
+			}
+		}
+		if c.Dropped() != 0 {
+			t.Fatal("dropped", c.Dropped())
+		}
+	})
+
+	t.Run("DropNewest", func(t *testing.T) {
+		c := subscribe(jsonbarn.BackpressureDropNewest, nil)
+		for i := 1; i <= 3; i++ {
+			insert(t, writer, "INCIDENTS", i)
+		}
+		waitFor(t, "dropped", func() bool { return c.Dropped() == 2 })
+		if m := receive(t, c, "INSERT"); level(m) != 1 {
+			t.Fatal(string(m))
+		}
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		c := subscribe(jsonbarn.BackpressureDropOldest, nil)
+		for i := 1; i <= 3; i++ {
+			insert(t, writer, "INCIDENTS", i)
+		}
+		waitFor(t, "dropped", func() bool { return c.Dropped() == 2 })
+		if m := receive(t, c, "INSERT"); level(m) != 3 {
+			t.Fatal(string(m))
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		states := make(chan error, 10)
+		c := subscribe(jsonbarn.BackpressureDisconnect, states)
+		insert(t, writer, "INCIDENTS", 1)
+		insert(t, writer, "INCIDENTS", 2)
+		select {
+		case err := <-states:
+			if !errors.Is(err, jsonbarn.ErrReceiveChannelFull) {
+				t.Fatal(err)
+			}
+		case <-time.After(timeout):
+			t.Fatal("not disconnected")
+		}
+		if c.Dropped() == 0 {
+			t.Fatal("dropped", c.Dropped())
+		}
+	})
+}
+
+func TestChannelNeverRead(t *testing.T) {
+	srv := newServer(t)
+	writer := connect(t, srv.Options("ann", "secret"))
+
+	// the default policy, Ch is never read
+	opts := srv.Options("ann", "secret")
+	opts.BufferSize = 4
+	c := jsonbarn.NewClient()
+	if err := c.ConnectContext(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor(t, "login", func() bool { return c.State() == jsonbarn.StateLoggedIn })
+
+	m, err := c.Mirror("INCIDENTS", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		insert(t, writer, "INCIDENTS", i)
+	}
+
+	// the replies and the mirror are not blocked by the broadcasts
+	waitFor(t, "mirror", func() bool { return m.Len() == 20 })
+	items, err := c.All("INCIDENTS")
+	if err != nil || len(items) != 20 {
+		t.Fatal(len(items), err)
+	}
+	if c.Dropped() == 0 {
+		t.Fatal("nothing dropped")
+	}
+}
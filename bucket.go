@@ -0,0 +1,200 @@
+/*
+
+This file contain Bucket, a typed access to a bucket that save Go structs as
+JSON objects and decode the items read into the same struct.
+
+	type Incident struct {
+		jsonbarn.Meta
+		Title string `json:"title"`
+	}
+
+	incidents := jsonbarn.NewBucket[Incident](client, "INCIDENTS")
+	items, err := incidents.All()
+
+*/
+
+package jsonbarn
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/tidwall/gjson"
+)
+
+/*Recurrence of an item, see Recurrentdate in the server (dates.go).
+ */
+type Recurrence struct {
+	StartDate             uint64  `json:"startdate"`             // date to start recurrence
+	Duration              int     `json:"duration"`              // in seconds
+	RecurrencePatternCode string  `json:"recurrencepatterncode"` // D for daily, W for weekly, M for monthly or Y for yearly
+	RecurEvery            int16   `json:"recurevery"`            // number of days, weeks, months or years between occurrences
+	YearlyMonth           *int16  `json:"yearlymonth,omitempty"`
+	MonthlyWeekOfMonth    *int16  `json:"monthlyweekofmonth,omitempty"`
+	MonthlyDayOfWeek      *int16  `json:"monthlydayofweek,omitempty"`
+	MonthlyDay            *int16  `json:"monthlyday,omitempty"`
+	WeeklyDaysIncluded    *int16  `json:"weeklydaysincluded,omitempty"`
+	DailyIsOnlyWeekday    *bool   `json:"dailyisonlyweekday,omitempty"`
+	EndByDate             *uint64 `json:"endbydate,omitempty"`
+}
+
+/*Meta contain the system properties of an item, embed it in a struct to read
+and write them. Status is a pointer so an INSERT without a status does not
+send one, Bucket.Update never send it, see Bucket.UpdateStatus.
+*/
+type Meta struct {
+	ID               string      `json:"$id,omitempty"`
+	Bucketname       string      `json:"$bucketname,omitempty"`
+	CreatedBy        string      `json:"$createdby,omitempty"`
+	UpdatedBy        string      `json:"$updatedby,omitempty"`
+	CreatedTime      uint64      `json:"$createdtime,omitempty"`
+	UpdatedTime      uint64      `json:"$updatedtime,omitempty"`
+	CreatedOnNetwork string      `json:"$createdonnetwork,omitempty"`
+	CreatedOnServer  string      `json:"$createdonserver,omitempty"`
+	Status           *int        `json:"$status,omitempty"` // 0 pending, 1 active, 2 completed
+	AutoStatus       bool        `json:"$autostatus,omitempty"`
+	StartTime        uint64      `json:"$starttime,omitempty"`
+	EndTime          uint64      `json:"$endtime,omitempty"`
+	Recurrence       *Recurrence `json:"$recurrence,omitempty"`
+}
+
+/*Bucket give typed access to the items of a bucket.
+ */
+type Bucket[T any] struct {
+	j    *JsonBarn
+	name string
+}
+
+/*NewBucket return a typed access to a bucket.
+ */
+func NewBucket[T any](j *JsonBarn, bucketname string) *Bucket[T] {
+	return &Bucket[T]{j: j, name: bucketname}
+}
+
+/*Decode the items returned by a read into a slice of T.
+ */
+func Decode[T any](items []json.RawMessage) ([]T, error) {
+	result := make([]T, len(items))
+	for i := range items {
+		if err := json.Unmarshal(items[i], &result[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+/*Name return the name of the bucket.
+ */
+func (b *Bucket[T]) Name() string {
+	return b.name
+}
+
+/*Insert add an item into the bucket, $id is use as the key if set.
+ */
+func (b *Bucket[T]) Insert(item *T, defered uint64) error {
+	return b.j.Insert(b.name, item, defered)
+}
+
+/*Update save an item of the bucket, $id must be set. $status is not sent,
+the server keep the status saved, use UpdateStatus to change it.
+*/
+func (b *Bucket[T]) Update(item *T, defered uint64) error {
+	return b.update(item, defered, false)
+}
+
+/*UpdateStatus save an item of the bucket including its $status, the user need
+the statuschange right of the bucket.
+*/
+func (b *Bucket[T]) UpdateStatus(item *T, defered uint64) error {
+	return b.update(item, defered, true)
+}
+
+func (b *Bucket[T]) update(item *T, defered uint64, status bool) error {
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	id := gjson.GetBytes(data, "$id").String()
+	if id == "" {
+		return errors.New("Unable to update object no ID property defined.")
+	}
+
+	// the server refuse an update that contain the status without the statuschange right
+	if !status {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		delete(fields, "$status")
+		delete(fields, "$itemstatus")
+		if data, err = json.Marshal(fields); err != nil {
+			return err
+		}
+	}
+
+	return b.j.write(&Command{Action: "UPDATE", Bucketname: b.name, Key: id, Defered: defered, Data: data})
+}
+
+/*Delete remove the item with the $id provided.
+ */
+func (b *Bucket[T]) Delete(id string, defered uint64) error {
+	return b.j.Delete(b.name, id, defered)
+}
+
+/*One return the first item where searchfield is equal to value, nil if none.
+ */
+func (b *Bucket[T]) One(searchfield, value, fieldtype string) (*T, error) {
+
+	item, err := b.j.One(b.name, searchfield, value, fieldtype)
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	result := new(T)
+	if err := json.Unmarshal(item, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+/*Many return all items where searchfield is equal to value.
+ */
+func (b *Bucket[T]) Many(searchfield, value, fieldtype string) ([]T, error) {
+	items, err := b.j.Many(b.name, searchfield, value, fieldtype)
+	if err != nil {
+		return nil, err
+	}
+	return Decode[T](items)
+}
+
+/*Range return all items where searchfield is between minvalue and maxvalue.
+ */
+func (b *Bucket[T]) Range(searchfield, minvalue, maxvalue, fieldtype string) ([]T, error) {
+	items, err := b.j.Range(b.name, searchfield, minvalue, maxvalue, fieldtype)
+	if err != nil {
+		return nil, err
+	}
+	return Decode[T](items)
+}
+
+/*All return all items of the bucket.
+ */
+func (b *Bucket[T]) All() ([]T, error) {
+	items, err := b.j.All(b.name)
+	if err != nil {
+		return nil, err
+	}
+	return Decode[T](items)
+}
+
+/*Query return all items that match all the conditions.
+ */
+func (b *Bucket[T]) Query(conditions []QueryItem) ([]T, error) {
+	items, err := b.j.Query(b.name, conditions)
+	if err != nil {
+		return nil, err
+	}
+	return Decode[T](items)
+}
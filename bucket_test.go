@@ -0,0 +1,47 @@
+package jsonbarn_test
+
+import (
+	"testing"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/marcgauthier/jsonbarn/jsonbarntest"
+	"github.com/tidwall/gjson"
+)
+
+type incident struct {
+	jsonbarn.Meta
+	Title string `json:"title"`
+}
+
+func TestBucketUpdateStatus(t *testing.T) {
+	srv := newServer(t)
+	srv.AddUser(jsonbarntest.User{Name: "bob", Password: "secret", Rights: []string{"INCIDENTS-read", "INCIDENTS-update"}})
+	id, _ := srv.Put("INCIDENTS", map[string]interface{}{"title": "fire", "$status": 1})
+
+	c := connect(t, srv.Options("bob", "secret"))
+	incidents := jsonbarn.NewBucket[incident](c, "INCIDENTS")
+
+	// an item read and saved again does not change its status
+	items, err := incidents.All()
+	if err != nil || len(items) != 1 || items[0].Status == nil {
+		t.Fatal(items, err)
+	}
+	items[0].Title = "flood"
+	if err := incidents.Update(&items[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	item := srv.Items("INCIDENTS")[0]
+	if gjson.GetBytes(item, "title").String() != "flood" || gjson.GetBytes(item, "$status").Int() != 1 {
+		t.Fatal(string(item))
+	}
+
+	// changing the status need the statuschange right
+	status := 2
+	items[0].Status = &status
+	if err := incidents.UpdateStatus(&items[0], 0); err == nil {
+		t.Fatal("status changed without the statuschange right")
+	}
+	if item := srv.Items("INCIDENTS")[0]; gjson.GetBytes(item, "$id").String() != id || gjson.GetBytes(item, "$status").Int() != 1 {
+		t.Fatal(string(item))
+	}
+}
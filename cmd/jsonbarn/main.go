@@ -0,0 +1,531 @@
+/*
+
+jsonbarn is a command-line tool to work with a JSONBARN server, it use the
+same websocket actions than the other clients so the rights of the user are
+enforced by the server.
+
+	jsonbarn [flags] command [arguments]
+
+	login                             check the credential and print the time of the server
+	get BUCKET [ID]                   print one item, or all the items of the bucket
+	find [-type T] BUCKET FIELD VALUE print the items where FIELD is equal to VALUE
+	range [-type T] BUCKET FIELD MIN MAX
+	query BUCKET [FILE]               FILE contain a JSON array of conditions (QueryItem)
+	insert BUCKET [FILE]              FILE contain one JSON object or an array of objects
+	update [FILE]                     objects must contain $id and $bucketname
+	delete BUCKET [ID...]             ids are read from stdin, one per line, if none are given
+	tail BUCKET...                    print the changes made to the buckets until interrupted
+	logs [-since D | -start T -end T] print the changes logged by the server
+	config get | config put [FILE]
+
+FILE is read from stdin when missing or "-". Items are printed as NDJSON, one
+JSON object per line. The password can be set with JSONBARN_PASSWORD.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/tidwall/gjson"
+)
+
+/* settings common to all the commands.
+ */
+type settings struct {
+	host     string
+	port     string
+	path     string
+	username string
+	password string
+	cafile   string
+	insecure bool
+	ws       bool
+	timeout  time.Duration
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "jsonbarn:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+
+	s := &settings{}
+
+	fs := flag.NewFlagSet("jsonbarn", flag.ContinueOnError)
+	fs.StringVar(&s.host, "host", env("JSONBARN_HOST", "localhost"), "host of the server")
+	fs.StringVar(&s.port, "port", env("JSONBARN_PORT", "443"), "port of the server")
+	fs.StringVar(&s.path, "path", env("JSONBARN_PATH", "/wss/"), "path of the websocket")
+	fs.StringVar(&s.username, "user", env("JSONBARN_USER", ""), "username")
+	fs.StringVar(&s.password, "password", "", "password, default $JSONBARN_PASSWORD")
+	fs.StringVar(&s.cafile, "ca", "", "PEM file of the CA used to verify the server")
+	fs.BoolVar(&s.insecure, "insecure", false, "do not verify the certificate of the server")
+	fs.BoolVar(&s.ws, "ws", false, "connect with ws:// instead of wss://")
+	fs.DurationVar(&s.timeout, "timeout", 30*time.Second, "maximum time to wait for the server")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: jsonbarn [flags] login|get|find|range|query|insert|update|delete|tail|logs|config [arguments]")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if s.password == "" {
+		s.password = os.Getenv("JSONBARN_PASSWORD")
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing command")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	command, args := fs.Arg(0), fs.Args()[1:]
+
+	commands := map[string]func(context.Context, *jsonbarn.JsonBarn, []string) error{
+		"login":  login,
+		"get":    get,
+		"find":   find,
+		"range":  readRange,
+		"query":  query,
+		"insert": insert,
+		"update": update,
+		"delete": remove,
+		"tail":   tail,
+		"logs":   logs,
+		"config": config,
+	}
+
+	f, ok := commands[command]
+	if !ok {
+		return errors.New("unknown command " + command)
+	}
+
+	client, err := connect(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return f(ctx, client, args)
+}
+
+func env(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
+
+/* connect login to the server and wait until the login is accepted.
+ */
+func connect(ctx context.Context, s *settings) (*jsonbarn.JsonBarn, error) {
+
+	opts := jsonbarn.Options{
+		Host:               s.host,
+		Port:               s.port,
+		Path:               s.path,
+		Username:           s.username,
+		Password:           s.password,
+		InsecureSkipVerify: s.insecure,
+		AllowInsecureWS:    s.ws,
+	}
+
+	if s.cafile != "" {
+		pem, err := os.ReadFile(s.cafile)
+		if err != nil {
+			return nil, err
+		}
+		opts.RootCAs = x509.NewCertPool()
+		if !opts.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + s.cafile)
+		}
+	}
+
+	// the first state that end the wait, or the last error while connecting
+	done := make(chan error, 1)
+	lasterr := make(chan error, 1)
+	opts.OnState = func(state jsonbarn.State, err error) {
+		switch state {
+		case jsonbarn.StateLoggedIn:
+			select {
+			case done <- nil:
+			default:
+			}
+		case jsonbarn.StateLoginFailed:
+			select {
+			case done <- err:
+			default:
+			}
+		case jsonbarn.StateDisconnected:
+			if err != nil {
+				select {
+				case <-lasterr:
+				default:
+				}
+				lasterr <- err
+			}
+		}
+	}
+
+	client := jsonbarn.NewClient()
+	client.Timeout = s.timeout
+	if err := client.ConnectContext(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = errors.New("unable to login before timeout")
+		select {
+		case last := <-lasterr:
+			err = fmt.Errorf("%v: %w", err, last)
+		default:
+		}
+	}
+
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+/* input return the content of a file, stdin if name is empty or "-".
+ */
+func input(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+/* objects return the objects of a file that contain one object or an array.
+ */
+func objects(name string) ([]json.RawMessage, error) {
+
+	data, err := input(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		items := []json.RawMessage{}
+		err := json.Unmarshal(data, &items)
+		return items, err
+	}
+
+	if !gjson.ValidBytes(data) || !gjson.ParseBytes(data).IsObject() {
+		return nil, errors.New("input must be a JSON object or an array of objects")
+	}
+	return []json.RawMessage{data}, nil
+}
+
+/* arg return the optional argument i or "".
+ */
+func arg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+/* output write the items as NDJSON.
+ */
+func output(items ...json.RawMessage) error {
+
+	w := bufio.NewWriter(os.Stdout)
+	for _, item := range items {
+		line := &bytes.Buffer{}
+		if err := json.Compact(line, item); err != nil {
+			return err
+		}
+		line.WriteByte('\n')
+		if _, err := w.Write(line.Bytes()); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func login(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	t, err := client.GetTime()
+	if err != nil {
+		return err
+	}
+	fmt.Println("logged in, time of the server is", t.Format(time.RFC3339))
+	return nil
+}
+
+func get(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: get BUCKET [ID]")
+	}
+
+	if len(args) == 1 {
+		items, err := client.All(args[0])
+		if err != nil {
+			return err
+		}
+		return output(items...)
+	}
+
+	item, err := client.One(args[0], "$id", args[1], jsonbarn.FieldText)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return errors.New("item " + args[1] + " not found")
+	}
+	return output(item)
+}
+
+func find(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	fs := flag.NewFlagSet("find", flag.ContinueOnError)
+	fieldtype := fs.String("type", jsonbarn.FieldText, "type of the field BIGINT, INT, TEXT, DECIMAL or DOUBLE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return errors.New("usage: find [-type T] BUCKET FIELD VALUE")
+	}
+
+	items, err := client.Many(fs.Arg(0), fs.Arg(1), fs.Arg(2), strings.ToUpper(*fieldtype))
+	if err != nil {
+		return err
+	}
+	return output(items...)
+}
+
+func readRange(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	fs := flag.NewFlagSet("range", flag.ContinueOnError)
+	fieldtype := fs.String("type", jsonbarn.FieldText, "type of the field BIGINT, INT, TEXT, DECIMAL or DOUBLE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 4 {
+		return errors.New("usage: range [-type T] BUCKET FIELD MIN MAX")
+	}
+
+	items, err := client.Range(fs.Arg(0), fs.Arg(1), fs.Arg(2), fs.Arg(3), strings.ToUpper(*fieldtype))
+	if err != nil {
+		return err
+	}
+	return output(items...)
+}
+
+func query(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: query BUCKET [FILE]")
+	}
+
+	data, err := input(arg(args, 1))
+	if err != nil {
+		return err
+	}
+
+	conditions := []jsonbarn.QueryItem{}
+	if err := json.Unmarshal(data, &conditions); err != nil {
+		return err
+	}
+
+	items, err := client.Query(args[0], conditions)
+	if err != nil {
+		return err
+	}
+	return output(items...)
+}
+
+func insert(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: insert BUCKET [FILE]")
+	}
+
+	items, err := objects(arg(args, 1))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := client.Insert(args[0], item, 0); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stderr, len(items), "item(s) inserted")
+	return nil
+}
+
+func update(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	if len(args) > 1 {
+		return errors.New("usage: update [FILE]")
+	}
+
+	items, err := objects(arg(args, 0))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := client.Update(item, 0); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stderr, len(items), "item(s) updated")
+	return nil
+}
+
+func remove(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	if len(args) < 1 {
+		return errors.New("usage: delete BUCKET [ID...]")
+	}
+
+	ids := args[1:]
+	if len(ids) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if id := strings.TrimSpace(scanner.Text()); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		if err := client.Delete(args[0], id, 0); err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	}
+	fmt.Fprintln(os.Stderr, len(ids), "item(s) deleted")
+	return nil
+}
+
+func tail(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	if len(args) == 0 {
+		return errors.New("usage: tail BUCKET...")
+	}
+
+	for _, bucketname := range args {
+		if err := client.RegisterEvent(bucketname); err != nil {
+			return fmt.Errorf("%s: %w", bucketname, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case message := <-client.Ch:
+			switch gjson.GetBytes(message, "action").String() {
+			case "INSERT", "UPDATE", "DELETE":
+				if err := output(message); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func logs(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	since := fs.Duration("since", time.Hour, "print the changes made since this duration")
+	start := fs.String("start", "", "start of the window (RFC3339), replace -since")
+	end := fs.String("end", "", "end of the window (RFC3339), default now")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	endtime := time.Now()
+	starttime := endtime.Add(-*since)
+
+	var err error
+	if *end != "" {
+		if endtime, err = time.Parse(time.RFC3339, *end); err != nil {
+			return err
+		}
+	}
+	if *start != "" {
+		if starttime, err = time.Parse(time.RFC3339, *start); err != nil {
+			return err
+		}
+	}
+
+	entries, err := client.GetLogs(starttime, endtime)
+	if err != nil {
+		return err
+	}
+
+	items := make([]json.RawMessage, len(entries))
+	for i := range entries {
+		if items[i], err = json.Marshal(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return output(items...)
+}
+
+func config(ctx context.Context, client *jsonbarn.JsonBarn, args []string) error {
+
+	switch arg(args, 0) {
+
+	case "get":
+		configuration, err := client.GetConfig()
+		if err != nil {
+			return err
+		}
+		return output(configuration)
+
+	case "put":
+		data, err := input(arg(args, 1))
+		if err != nil {
+			return err
+		}
+		if !gjson.ValidBytes(data) {
+			return errors.New("configuration is not valid JSON")
+		}
+		if err := client.PutConfig(json.RawMessage(data)); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "configuration saved")
+		return nil
+	}
+
+	return errors.New("usage: config get | config put [FILE]")
+}
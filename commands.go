@@ -0,0 +1,884 @@
+/*
+
+This file contain the typed API of the JSONBARN client, each function build
+a command using the same structure the server expect (models.MsgClientCmd)
+and decode the reply sent back by the server.
+
+*/
+
+package jsonbarn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+/*Valid field type for One, Many, Range and Query
+ */
+const (
+	FieldBigint  = "BIGINT"
+	FieldInt     = "INT"
+	FieldText    = "TEXT"
+	FieldDecimal = "DECIMAL"
+	FieldDouble  = "DOUBLE"
+)
+
+/*ErrTimeout is returned when the server did not reply in time.
+ */
+var ErrTimeout = errors.New("Timeout")
+
+/*ServerError is returned when the server reply to a command with a message,
+i.e. access denied.
+*/
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+/*RateLimitError is returned when the server refused a command because the
+client sent too many commands of its class (read, write or admin), the command
+can be sent again after RetryAfter.
+*/
+type RateLimitError struct {
+	Class      string
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Message
+}
+
+/*Command is the payload sent to the server, it mirror the MsgClientCmd structure
+of the server.
+*/
+type Command struct {
+	Action      string          `json:"action"`                // action LOGIN, READ, DELETE, UPDATE
+	Username    string          `json:"username,omitempty"`    // only use for LOGIN
+	Password    string          `json:"password,omitempty"`    // only use for LOGIN
+	Bucketname  string          `json:"bucketname,omitempty"`  // bucket name is the table that need to be update.
+	SearchField string          `json:"searchfield,omitempty"` // property to search
+	Key         string          `json:"key,omitempty"`         // Key to insert,edit or query data.
+	MaxKey      string          `json:"maxkey,omitempty"`      // upper value for READRANGE
+	Field       string          `json:"field,omitempty"`       // type of the searchfield, see Field* constants
+	Defered     uint64          `json:"defered,omitempty"`     // execute command at a later date (unix seconds)
+	Data        json.RawMessage `json:"data,omitempty"`        // JSON object
+	RequestID   string          `json:"requestid,omitempty"`   // set by Call, echoed by the server in the reply
+	Version     int             `json:"version,omitempty"`     // protocol version, only use for LOGIN
+}
+
+/*QueryItem one condition of a QUERY, see buildQuery on the server.
+
+Searchtype can be EQ, GT, GTE, LT, LTE or BETWEEN, Values contain one value
+except for BETWEEN that need two, Logic is AND, OR or "" for the last item.
+*/
+type QueryItem struct {
+	Property   string   `json:"property"`
+	Type       string   `json:"type"`
+	Searchtype string   `json:"st"`
+	Values     []string `json:"values"`
+	Logic      string   `json:"logic"`
+}
+
+/*User as returned by GetUsers, password information is never sent by the server.
+ */
+type User struct {
+	ID       string   `json:"$id"`
+	Name     string   `json:"name"`
+	Contact  string   `json:"contact"`
+	Rights   []string `json:"rights"`
+	Groups   []string `json:"group"`
+	Settings []byte   `json:"settings"`
+}
+
+/*LogEntry one item of the LOGS table as returned by GetLogs.
+ */
+type LogEntry struct {
+	ID           int64           `json:"$id"`
+	TimeOfAction time.Time       `json:"timeofaction"`
+	Bucketname   string          `json:"bucketname"`
+	JSONID       string          `json:"jsonid"`
+	Username     string          `json:"username"`
+	Action       string          `json:"action"`
+	PreviousData json.RawMessage `json:"previousdata"`
+	NewData      json.RawMessage `json:"newdata"`
+}
+
+/* reply of a read request {"action":"read", "bucketname":"", "items":[]}
+ */
+type readReply struct {
+	Action     string            `json:"action"`
+	Bucketname string            `json:"bucketname"`
+	Items      []json.RawMessage `json:"items"`
+}
+
+/* dispatch give a reply to the request waiting for it, replies are matched
+using the requestid echoed by the server. Return false if the message is not
+a reply to a request (i.e. a broadcast).
+*/
+func (j *JsonBarn) dispatch(message []byte) bool {
+
+	requestid := gjson.GetBytes(message, "requestid").String()
+	if requestid == "" {
+		return false
+	}
+
+	j.mu.Lock()
+	reply, ok := j.pending[requestid]
+	delete(j.pending, requestid)
+	j.mu.Unlock()
+
+	// if the request already timed out the reply is discarded
+	if ok {
+		reply <- message
+	}
+	return true
+}
+
+/*SendCommand serialize and send a command to the server without waiting for a reply.
+ */
+func (j *JsonBarn) SendCommand(cmd *Command) error {
+	msg, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return j.Send(string(msg))
+}
+
+/*Call send a command to the server and wait up to timeout for the reply, the
+raw reply of the server is returned. Unlike SendCommand, the reply is not sent
+to the Ch channel.
+*/
+func (j *JsonBarn) Call(cmd *Command, timeout time.Duration) ([]byte, error) {
+
+	if j == nil {
+		return nil, errors.New("JsonBarnIsNil")
+	}
+
+	reply := make(chan []byte, 1)
+
+	j.mu.Lock()
+	j.requestid++
+	cmd.RequestID = strconv.FormatUint(j.requestid, 10)
+	j.pending[cmd.RequestID] = reply
+	j.mu.Unlock()
+
+	cancel := func() {
+		j.mu.Lock()
+		delete(j.pending, cmd.RequestID)
+		j.mu.Unlock()
+	}
+
+	if err := j.SendCommand(cmd); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message := <-reply:
+		if message == nil {
+			return nil, ErrDisconnected
+		}
+		return message, nil
+	case <-timer.C:
+		cancel()
+		return nil, ErrTimeout
+	}
+}
+
+/* request send a command and wait for the reply, a "message" reply is returned
+as an error.
+*/
+func (j *JsonBarn) request(cmd *Command) ([]byte, error) {
+
+	message, err := j.Call(cmd, j.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	switch gjson.GetBytes(message, "action").String() {
+	case "message":
+		return message, &ServerError{Message: gjson.GetBytes(message, "message").String()}
+	case "ratelimited":
+		return message, &RateLimitError{
+			Class:      gjson.GetBytes(message, "class").String(),
+			RetryAfter: time.Duration(gjson.GetBytes(message, "retryafter").Int()) * time.Millisecond,
+			Message:    gjson.GetBytes(message, "message").String(),
+		}
+	}
+	return message, nil
+}
+
+/* write send a command that only reply when it fails, i.e. INSERT, UPDATE and
+DELETE, the server send an "ack" once the command is accepted. If the offline
+queue is enabled the command is queued when the client is not logged in or
+when older writes are still waiting in the queue.
+*/
+func (j *JsonBarn) write(cmd *Command) error {
+	if j.queue != nil && (j.State() != StateLoggedIn || j.queue.len() > 0) {
+		return j.queue.push(cmd, nil)
+	}
+	_, err := j.request(cmd)
+	return err
+}
+
+/* status send a command for which the server reply with the action in
+lowercase and a status, i.e. {"action":"indexcreate", "status":true}. A
+failure is a "message" returned as an error by request.
+*/
+func (j *JsonBarn) status(cmd *Command) error {
+
+	message, err := j.request(cmd)
+	if err != nil {
+		return err
+	}
+
+	if gjson.GetBytes(message, "action").String() != strings.ToLower(cmd.Action) || !gjson.GetBytes(message, "status").Bool() {
+		return &ServerError{Message: "Unexpected reply to " + cmd.Action + ": " + string(message)}
+	}
+	return nil
+}
+
+/* read send a read command and return the items of the reply.
+ */
+func (j *JsonBarn) read(cmd *Command) ([]json.RawMessage, error) {
+
+	message, err := j.request(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	r := readReply{}
+	if err := json.Unmarshal(message, &r); err != nil {
+		return nil, err
+	}
+	return r.Items, nil
+}
+
+func validFieldType(fieldtype string) error {
+	if fieldtype != FieldBigint && fieldtype != FieldText && fieldtype != FieldInt && fieldtype != FieldDecimal && fieldtype != FieldDouble {
+		return errors.New("Invalid field type, must be either INT, BIGINT, TEXT, DECIMAL or DOUBLE")
+	}
+	return nil
+}
+
+/*Insert add an object into a bucket, if object contain a $id property it will
+be use as the key. defered is the unix time when the insert must be executed, 0 for now.
+*/
+func (j *JsonBarn) Insert(bucketname string, object interface{}, defered uint64) error {
+
+	if bucketname == "" {
+		return errors.New("Unable to insert object no bucketname was provided.")
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	return j.write(&Command{
+		Action:     "INSERT",
+		Bucketname: bucketname,
+		Key:        gjson.GetBytes(data, "$id").String(),
+		Defered:    defered,
+		Data:       data,
+	})
+}
+
+/*Update save an object, the object must contain $id and $bucketname properties.
+ */
+func (j *JsonBarn) Update(object interface{}, defered uint64) error {
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	id := gjson.GetBytes(data, "$id").String()
+	if id == "" {
+		return errors.New("Unable to update object no ID property defined.")
+	}
+
+	bucketname := gjson.GetBytes(data, "$bucketname").String()
+	if bucketname == "" {
+		return errors.New("Unable to update object no bucketname was provided.")
+	}
+
+	return j.write(&Command{
+		Action:     "UPDATE",
+		Bucketname: bucketname,
+		Key:        id,
+		Defered:    defered,
+		Data:       data,
+	})
+}
+
+/*Delete remove the object with the $id provided from a bucket.
+ */
+func (j *JsonBarn) Delete(bucketname, id string, defered uint64) error {
+
+	if id == "" {
+		return errors.New("Unable to delete object no ID provided.")
+	}
+
+	if bucketname == "" {
+		return errors.New("Unable to delete object no bucketname was provided.")
+	}
+
+	return j.write(&Command{Action: "DELETE", Bucketname: bucketname, Key: id, Defered: defered})
+}
+
+/*UpdateUserSettings merge the properties of object into the settings of the current user.
+ */
+func (j *JsonBarn) UpdateUserSettings(object interface{}) error {
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	return j.write(&Command{Action: "SETUSERSETTING", Data: data})
+}
+
+/*One return the first item of the bucket where searchfield is equal to value, nil if none.
+ */
+func (j *JsonBarn) One(bucketname, searchfield, value, fieldtype string) (json.RawMessage, error) {
+
+	if err := validFieldType(fieldtype); err != nil {
+		return nil, err
+	}
+
+	items, err := j.read(&Command{Action: "READONE", Bucketname: bucketname, Key: value, SearchField: searchfield, Field: fieldtype})
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+/*Many return all items of the bucket where searchfield is equal to value.
+ */
+func (j *JsonBarn) Many(bucketname, searchfield, value, fieldtype string) ([]json.RawMessage, error) {
+
+	if err := validFieldType(fieldtype); err != nil {
+		return nil, err
+	}
+
+	return j.read(&Command{Action: "READFIND", Bucketname: bucketname, Key: value, SearchField: searchfield, Field: fieldtype})
+}
+
+/*Range return all items of the bucket where searchfield is between minvalue and maxvalue.
+ */
+func (j *JsonBarn) Range(bucketname, searchfield, minvalue, maxvalue, fieldtype string) ([]json.RawMessage, error) {
+
+	if err := validFieldType(fieldtype); err != nil {
+		return nil, err
+	}
+
+	return j.read(&Command{Action: "READRANGE", Bucketname: bucketname, Key: minvalue, MaxKey: maxvalue, SearchField: searchfield, Field: fieldtype})
+}
+
+/*All return all items of a bucket.
+ */
+func (j *JsonBarn) All(bucketname string) ([]json.RawMessage, error) {
+	return j.read(&Command{Action: "READALL", Bucketname: bucketname})
+}
+
+/*Query return all items of a bucket that match all the conditions.
+ */
+func (j *JsonBarn) Query(bucketname string, conditions []QueryItem) ([]json.RawMessage, error) {
+
+	data, err := json.Marshal(conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	return j.read(&Command{Action: "QUERY", Bucketname: bucketname, Data: data})
+}
+
+/* subscription is a bucket passed to RegisterEvent or RegisterEventFilter, an
+object passed to Watch or a bucket passed to ListenPresence.
+*/
+type subscription struct {
+	bucketname string
+	filter     json.RawMessage // conditions, nil for all the changes
+	id         string          // $id of the object watched, empty for a bucket
+	presence   bool            // presence events of the bucket
+	count      int             // number of times it was registered
+	login      uint64          // login in which it was sent to the server
+}
+
+/* same return true if r is the same registration as s. */
+func (s subscription) same(r subscription) bool {
+	return r.bucketname == s.bucketname && r.id == s.id && r.presence == s.presence && bytes.Equal(r.filter, s.filter)
+}
+
+/* action return the action to send to the server to register or unregister. */
+func (s subscription) action(register bool) string {
+	switch {
+	case s.presence:
+		return "PRESENCE"
+	case s.id != "" && register:
+		return "WATCH"
+	case s.id != "":
+		return "UNWATCH"
+	case register:
+		return "REGISTEREVENT"
+	}
+	return "UNREGISTEREVENT"
+}
+
+/* key return the key to send to the server to register or unregister. */
+func (s subscription) key(register bool) string {
+	switch {
+	case s.presence && register:
+		return "on"
+	case s.presence:
+		return "off"
+	}
+	return s.id
+}
+
+/*RegisterEvent ask the server to send INSERT, UPDATE and DELETE made in a bucket,
+the changes are received on the Ch channel. The changes are sent until
+UnregisterEvent is called as many times as RegisterEvent.
+*/
+func (j *JsonBarn) RegisterEvent(bucketname string) error {
+	return j.register(subscription{bucketname: bucketname})
+}
+
+/*RegisterEventFilter ask the server to send INSERT, UPDATE and DELETE made in a
+bucket to the objects that match the conditions, an UPDATE is sent if the
+object match before or after the change.
+*/
+func (j *JsonBarn) RegisterEventFilter(bucketname string, conditions []QueryItem) error {
+
+	filter, err := json.Marshal(conditions)
+	if err != nil {
+		return err
+	}
+
+	return j.register(subscription{bucketname: bucketname, filter: filter})
+}
+
+/* register count the registrations of a subscription, it is only sent to the
+server the first time so a Mirror and the application can register the same
+bucket.
+*/
+func (j *JsonBarn) register(s subscription) error {
+
+	j.smu.Lock()
+	defer j.smu.Unlock()
+
+	j.mu.Lock()
+	for i := range j.registered {
+		if j.registered[i].same(s) {
+			j.registered[i].count++
+			j.mu.Unlock()
+			return nil
+		}
+	}
+	login := j.logins
+	j.mu.Unlock()
+
+	if err := j.registration(s, true); err != nil {
+		return err
+	}
+
+	// remember the bucket so it can be registered again after a reconnect
+	s.count = 1
+	s.login = login
+	j.mu.Lock()
+	j.registered = append(j.registered, s)
+	j.mu.Unlock()
+	return nil
+}
+
+/*UnregisterEvent ask the server to stop sending changes made in a bucket.
+ */
+func (j *JsonBarn) UnregisterEvent(bucketname string) error {
+	return j.unregister(subscription{bucketname: bucketname})
+}
+
+/*UnregisterEventFilter remove a registration made with RegisterEventFilter, the
+conditions must be the same.
+*/
+func (j *JsonBarn) UnregisterEventFilter(bucketname string, conditions []QueryItem) error {
+
+	filter, err := json.Marshal(conditions)
+	if err != nil {
+		return err
+	}
+
+	return j.unregister(subscription{bucketname: bucketname, filter: filter})
+}
+
+/* unregister is only sent to the server when the subscription was unregistered
+as many times as it was registered.
+*/
+func (j *JsonBarn) unregister(s subscription) error {
+
+	j.smu.Lock()
+	defer j.smu.Unlock()
+
+	j.mu.Lock()
+	for i := range j.registered {
+		if j.registered[i].same(s) && j.registered[i].count > 1 {
+			j.registered[i].count--
+			j.mu.Unlock()
+			return nil
+		}
+	}
+	j.mu.Unlock()
+
+	if err := j.registration(s, false); err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range j.registered {
+		if j.registered[i].same(s) {
+			j.registered = append(j.registered[:i], j.registered[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+/*Watch ask the server to send the UPDATE and DELETE made to one object of a
+bucket, the changes are received on the Ch channel. A change is sent once when
+the bucket is also registered.
+*/
+func (j *JsonBarn) Watch(bucketname, id string) error {
+	if id == "" {
+		return errors.New("Unable to watch object no ID provided.")
+	}
+	return j.register(subscription{bucketname: bucketname, id: id})
+}
+
+/*Unwatch ask the server to stop sending the changes made to an object.
+ */
+func (j *JsonBarn) Unwatch(bucketname, id string) error {
+	if id == "" {
+		return errors.New("Unable to unwatch object no ID provided.")
+	}
+	return j.unregister(subscription{bucketname: bucketname, id: id})
+}
+
+/*Presence return the users registered to a bucket, or the users online when
+bucketname is empty, user must have the read right of the bucket or
+PRESENCE-read for the users online.
+*/
+func (j *JsonBarn) Presence(bucketname string) ([]string, error) {
+
+	message, err := j.request(&Command{Action: "PRESENCE", Bucketname: bucketname})
+	if err != nil {
+		return nil, err
+	}
+
+	if !gjson.GetBytes(message, "status").Bool() {
+		return nil, errors.New(gjson.GetBytes(message, "error").String())
+	}
+
+	users := []string{}
+	for _, v := range gjson.GetBytes(message, "users").Array() {
+		users = append(users, v.String())
+	}
+	return users, nil
+}
+
+/*ListenPresence ask the server to send an event when a user register to a bucket
+or unregister from it, or when a user join or leave when bucketname is empty.
+The events are received on the Ch channel.
+*/
+func (j *JsonBarn) ListenPresence(bucketname string) error {
+	return j.register(subscription{bucketname: bucketname, presence: true})
+}
+
+/*UnlistenPresence ask the server to stop sending the presence events of a bucket.
+ */
+func (j *JsonBarn) UnlistenPresence(bucketname string) error {
+	return j.unregister(subscription{bucketname: bucketname, presence: true})
+}
+
+/* resubscribe register again the buckets and objects after the server accepted the login
+of a new connection, the server forget the registration when a connection is lost.
+*/
+func (j *JsonBarn) resubscribe(ctx context.Context) {
+
+	j.mu.Lock()
+	registered := len(j.registered)
+	j.mu.Unlock()
+
+	if registered == 0 {
+		return
+	}
+
+	// the sequence must be read before the first registration, the broadcasts
+	// received once registered would hide the changes missed. They are kept
+	// so resume does not put them again.
+	seq := j.Seq()
+	if seq > 0 {
+		j.mu.Lock()
+		j.resumed = map[uint64]bool{}
+		j.mu.Unlock()
+
+		defer func() {
+			j.mu.Lock()
+			j.resumed = nil
+			j.mu.Unlock()
+		}()
+	}
+
+	buckets, failed := j.registerAgain(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	// changes made while disconnected
+	if seq > 0 {
+		if err := j.resume(ctx, seq); err != nil {
+			j.log().Warn("jsonbarn: unable to resume", "seq", seq, "error", err)
+			failed = err
+			if errors.Is(err, ErrResyncNeeded) {
+				j.deliver(ctx, resyncMessage)
+			}
+		}
+	}
+
+	if err := j.syncMirrors(); err != nil {
+		failed = err
+	}
+
+	if j.opts.OnResubscribe != nil {
+		j.opts.OnResubscribe(buckets, failed)
+	}
+}
+
+/* resume ask the server to replay the changes made after seq to the buckets
+registered and the objects watched, they are put in Ch. The broadcasts kept in
+j.resumed by the caller are not put again, the mirrors are reloaded instead.
+*/
+func (j *JsonBarn) resume(ctx context.Context, seq uint64) error {
+
+	message, err := j.request(&Command{Action: "RESUME", Key: strconv.FormatUint(seq, 10)})
+	if err != nil {
+		return err
+	}
+
+	if !gjson.GetBytes(message, "status").Bool() {
+		if gjson.GetBytes(message, "resync").Bool() {
+			return ErrResyncNeeded
+		}
+		return errors.New(gjson.GetBytes(message, "error").String())
+	}
+
+	j.log().Debug("jsonbarn: resumed", "seq", seq, "changes", gjson.GetBytes(message, "items.#").Int())
+
+	for _, item := range gjson.GetBytes(message, "items").Array() {
+
+		j.mu.Lock()
+		received := j.resumed[item.Get("$seq").Uint()]
+		j.mu.Unlock()
+
+		if received {
+			continue
+		}
+		if err := j.deliver(ctx, []byte(item.Raw)); err != nil {
+			return err
+		}
+	}
+
+	j.advance(gjson.GetBytes(message, "seq").Uint())
+	return nil
+}
+
+/* registerAgain send the subscriptions to the server after a login, those
+registered since the login are not sent twice. Return the buckets and the last
+registration that failed.
+*/
+func (j *JsonBarn) registerAgain(ctx context.Context) ([]string, error) {
+
+	j.smu.Lock()
+	defer j.smu.Unlock()
+
+	j.mu.Lock()
+	registered := append([]subscription(nil), j.registered...)
+	login := j.logins
+	j.mu.Unlock()
+
+	var failed error
+	buckets := []string{}
+	for _, s := range registered {
+		if ctx.Err() != nil {
+			return buckets, ctx.Err()
+		}
+		if !s.presence {
+			buckets = append(buckets, s.bucketname)
+		}
+		if s.login == login {
+			continue
+		}
+		if err := j.registration(s, true); err != nil {
+			j.log().Warn("jsonbarn: unable to register event", "bucket", s.bucketname, "error", err)
+			failed = err
+			continue
+		}
+
+		j.mu.Lock()
+		for i := range j.registered {
+			if j.registered[i].same(s) {
+				j.registered[i].login = login
+			}
+		}
+		j.mu.Unlock()
+	}
+	return buckets, failed
+}
+
+func (j *JsonBarn) registration(s subscription, register bool) error {
+
+	message, err := j.request(&Command{Action: s.action(register), Bucketname: s.bucketname, Key: s.key(register), Data: s.filter})
+	if err != nil {
+		return err
+	}
+
+	if !gjson.GetBytes(message, "status").Bool() {
+		return errors.New(gjson.GetBytes(message, "error").String())
+	}
+	return nil
+}
+
+/*GetConfig return the configuration of the server, user must have CONFIGURATION-read right.
+ */
+func (j *JsonBarn) GetConfig() (json.RawMessage, error) {
+
+	items, err := j.read(&Command{Action: "GETCONFIG"})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.New("No configuration returned")
+	}
+	return items[0], nil
+}
+
+/*PutConfig overwrite the configuration of the server, user must have CONFIGURATION-write right.
+ */
+func (j *JsonBarn) PutConfig(configuration interface{}) error {
+
+	data, err := json.Marshal(configuration)
+	if err != nil {
+		return err
+	}
+
+	return j.status(&Command{Action: "PUTCONFIG", Data: data})
+}
+
+/*GetUsers return all the users, user must have admin right.
+ */
+func (j *JsonBarn) GetUsers() ([]User, error) {
+
+	items, err := j.read(&Command{Action: "GETUSERS"})
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, len(items))
+	for i := range items {
+		if err := json.Unmarshal(items[i], &users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+/*GetLogs return the changes made to the database between two dates, user must have admin right.
+ */
+func (j *JsonBarn) GetLogs(starttime, endtime time.Time) ([]LogEntry, error) {
+
+	items, err := j.read(&Command{
+		Action: "LOGS",
+		Key:    strconv.FormatInt(starttime.Unix(), 10),
+		MaxKey: strconv.FormatInt(endtime.Unix(), 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logs := make([]LogEntry, len(items))
+	for i := range items {
+		if err := json.Unmarshal(items[i], &logs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return logs, nil
+}
+
+/*GetTime return the current time on the server.
+ */
+func (j *JsonBarn) GetTime() (time.Time, error) {
+
+	message, err := j.request(&Command{Action: "GETTIME"})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(gjson.GetBytes(message, "time").Int(), 0), nil
+}
+
+/*SetEmailAlert request email alert for changes in buckets, the server send a confirmation email.
+ */
+func (j *JsonBarn) SetEmailAlert(email string, buckets []string) error {
+
+	data, err := json.Marshal(struct {
+		Email   string   `json:"email"`
+		Buckets []string `json:"buckets"`
+	}{email, buckets})
+	if err != nil {
+		return err
+	}
+
+	return j.status(&Command{Action: "EMAILALERT", Data: data})
+}
+
+/*IndexCreate create an index named indexname on a property, user must have createindex right.
+ */
+func (j *JsonBarn) IndexCreate(indexname, field string) error {
+	return j.status(&Command{Action: "INDEXCREATE", Key: indexname, SearchField: field})
+}
+
+/*IndexDrop remove an index, user must have dropindex right.
+ */
+func (j *JsonBarn) IndexDrop(indexname string) error {
+	return j.status(&Command{Action: "INDEXDROP", Key: indexname})
+}
+
+/*IndexList return the name of all the indexes, user must have listindex right.
+ */
+func (j *JsonBarn) IndexList() ([]string, error) {
+
+	message, err := j.request(&Command{Action: "INDEXLIST"})
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := []string{}
+	for _, v := range gjson.GetBytes(message, "indexes").Array() {
+		indexes = append(indexes, v.String())
+	}
+	return indexes, nil
+}
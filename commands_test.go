@@ -0,0 +1,32 @@
+package jsonbarn_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/marcgauthier/jsonbarn/jsonbarntest"
+)
+
+func TestIndex(t *testing.T) {
+	srv := newServer(t)
+	srv.AddUser(jsonbarntest.User{Name: "bob", Password: "secret", Rights: []string{"INCIDENTS-read"}})
+
+	c := connect(t, srv.Options("ann", "secret"))
+	if err := c.IndexCreate("incidents_level", "level"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.IndexDrop("incidents_level"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failures are the message of the server
+	var serverError *jsonbarn.ServerError
+	if err := c.IndexDrop("incidents_level"); !errors.As(err, &serverError) {
+		t.Fatal(err)
+	}
+	bob := connect(t, srv.Options("bob", "secret"))
+	if err := bob.IndexCreate("incidents_level", "level"); !errors.As(err, &serverError) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package jsonbarn_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/marcgauthier/jsonbarn/jsonbarntest"
+	"github.com/tidwall/gjson"
+)
+
+const timeout = 5 * time.Second
+
+func newServer(t *testing.T) *jsonbarntest.Server {
+	srv := jsonbarntest.NewServer(jsonbarntest.User{Name: "ann", Password: "secret", Rights: []string{"admin"}})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+/* connect log a client on the server and remove the login reply from Ch. */
+func connect(t *testing.T, opts jsonbarn.Options) *jsonbarn.JsonBarn {
+	c := jsonbarn.NewClient()
+	if err := c.ConnectContext(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if m := receive(t, c, "login"); gjson.GetBytes(m, "result").String() != "success" {
+		t.Fatal(string(m))
+	}
+	return c
+}
+
+/* receive return the next message of Ch with the action, the others are skipped. */
+func receive(t *testing.T, c *jsonbarn.JsonBarn, action string) []byte {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-c.Ch:
+			if gjson.GetBytes(m, "action").String() == action {
+				return m
+			}
+		case <-deadline:
+			t.Fatal("no " + action + " received")
+		}
+	}
+}
+
+/* waitFor wait until done return true. */
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func insert(t *testing.T, c *jsonbarn.JsonBarn, bucketname string, level int) {
+	t.Helper()
+	if err := c.Insert(bucketname, map[string]int{"level": level}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
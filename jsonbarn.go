@@ -1,165 +1,661 @@
 /*
 
 This package role is to connect to a JSONBARN server, a secure websocket connection
-is eastablish and the client can listen to specific buckets 
+is eastablish and the client can listen to specific buckets
 
 */
 
 package jsonbarn
 
 import (
+	"context"
 	"crypto/tls"
-	"github.com/gorilla/websocket"
-	"github.com/tidwall/gjson"
-	"net/url"
-	"fmt"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
 )
 
+/*Bufsize is the size of the receive channel Ch created by New and NewClient,
+minimum 128.
 
-/* This Public variable can be changed to show details of operation on the console for debuging
+Deprecated: set Options.BufferSize, Ch is sized by the first ConnectContext.
 */
-var ShowTrace bool = true 
+var Bufsize int = 2048
+
+/*ShowTrace has no effect, the client no longer print its traces.
 
-/* Size of the buffer for the receive channel, the minimum size is 128, default size is 2048 
+Deprecated: set Options.Logger and Options.TraceMessages to receive the logs
+of the client.
 */
-var Bufsize int = 2048
+var ShowTrace bool = true
 
+/*ErrDisconnected is returned to the requests waiting for a reply when the connection is lost.
+ */
+var ErrDisconnected = errors.New("Disconnected")
+
+/*ProtocolVersion version of the websocket protocol spoken by this client, it is
+sent with the LOGIN command and must match the version of the server.
+*/
+const ProtocolVersion = 1
+
+/*ErrLoginFailed is reported when the server refuse the credential, the client stop reconnecting.
+ */
+var ErrLoginFailed = errors.New("LoginFailed")
+
+/*ErrProtocolVersion is reported when the server does not speak the same protocol
+version than the client, the client stop reconnecting.
+*/
+var ErrProtocolVersion = errors.New("ProtocolVersionMismatch")
+
+/*ErrReceiveChannelFull is reported when the connection is closed by the
+BackpressureDisconnect policy.
+*/
+var ErrReceiveChannelFull = errors.New("ReceiveChannelFull")
+
+/*ErrResyncNeeded is reported to OnResubscribe when the server can't replay the
+changes missed while disconnected, a resync message is also put in Ch.
+*/
+var ErrResyncNeeded = errors.New("ResyncNeeded")
+
+/* resyncMessage tell the reader of Ch to reload its data, same message than the
+server send when it dropped broadcasts.
+*/
+var resyncMessage = []byte(`{"action":"resync", "message":"Some changes could not be sent, reload your data."}`)
 
-/* JsonBarn object 
+/*Backpressure policy applied when the receive channel Ch is full. The default
+drop the oldest message so a client that never read Ch still receive the
+replies of its commands and keep its mirrors up to date.
 */
+type Backpressure int
+
+const (
+	BackpressureDropOldest Backpressure = iota // remove the oldest message of Ch to make room, the default
+	BackpressureBlock                          // stop reading the connection until there is room in Ch, the replies wait too
+	BackpressureDropNewest                     // drop the message received
+	BackpressureDisconnect                     // close the connection, the client reconnect
+)
+
+/*State of the connection with the server.
+ */
+type State int32
+
+const (
+	StateDisconnected State = iota // not connected, waiting before the next attempt
+	StateConnecting                // dialing the server
+	StateConnected                 // websocket is open, login has been sent
+	StateLoggedIn                  // server accepted the credential
+	StateLoginFailed               // server refused the credential or the protocol version, the client stopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateLoggedIn:
+		return "logged in"
+	case StateLoginFailed:
+		return "login failed"
+	}
+	return "unknown"
+}
+
+/*Options of the connection to the server.
+ */
+type Options struct {
+	Host      string
+	Port      string
+	Path      string
+	Username  string
+	Password  string
+	TLSConfig *tls.Config // base TLS configuration, the options below are added to it
+
+	RootCAs            *x509.CertPool    // CA used to verify the server, default the CA of the system
+	ClientCertificates []tls.Certificate // certificates presented to the server (mutual TLS)
+	PinnedKeys         []string          // base64 SHA-256 of the public key of the server certificate, any match is accepted
+	InsecureSkipVerify bool              // do not verify the certificate of the server, a warning is logged or written to stderr
+	AllowInsecureWS    bool              // connect with ws:// instead of wss://, for local development only, warned like InsecureSkipVerify
+
+	Header http.Header                           // extra HTTP headers sent with the websocket handshake
+	Proxy  func(*http.Request) (*url.URL, error) // default use the proxy of the environment
+
+	MinBackoff time.Duration // first delay before reconnecting, default 500ms
+	MaxBackoff time.Duration // maximum delay before reconnecting, default 30s
+
+	// OnState is called from the connection goroutine every time the state
+	// change, err contain the reason of a disconnection. It must not block.
+	OnState func(state State, err error)
+
+	// OnResubscribe is called after a reconnect once the buckets passed to
+	// RegisterEvent have been registered again, changes made while the
+	// connection was lost have not been received. err is the last
+	// registration that failed.
+	OnResubscribe func(buckets []string, err error)
+
+	// QueuePath enable the offline queue, INSERT, UPDATE and DELETE made
+	// while the client is not logged in are saved in this file and sent once
+	// the client is logged in again.
+	QueuePath     string
+	QueueMaxItems int // maximum number of writes in the queue, default 10000
+	QueueMaxBytes int // maximum size of the writes in the queue, default 16MB
+
+	// OnWriteResult is called with the reply of the server to a write sent
+	// from the offline queue, unless a result function was given to Enqueue.
+	OnWriteResult func(cmd *Command, err error)
+
+	// BufferSize is the size of the receive channel Ch, default Bufsize (2048). Ch is
+	// sized by the first ConnectContext and never replaced after, a later
+	// ConnectContext with a different size return an error.
+	BufferSize   int
+	Backpressure Backpressure // what to do with a message when Ch is full
+
+	Logger        Logger // receive the logs of the client, nothing is logged if nil
+	TraceMessages bool   // log every message received at the debug level
+}
+
+/* JsonBarn object
+ */
 type JsonBarn struct {
-	c         *websocket.Conn
-	Ch		  chan []byte		//receive channel
-	exit      bool
-	connected bool
-	loggedIn  bool
-	showtrace bool
+	Ch        chan []byte // receive channel
 	NewDialer *websocket.Dialer
+	Timeout   time.Duration // maximum time to wait for a reply from the server
+
+	state   int32         // current State, access with atomic
+	dropped atomic.Uint64 // messages dropped because Ch was full
+	seq     atomic.Uint64 // highest $seq of the broadcasts received
+	opts    Options
+	cancel  context.CancelFunc // stop the connection goroutines
+	running context.Context    // context of the connection goroutines, nil once they stopped
+	wg      sync.WaitGroup     // running connection goroutines
+
+	mu         sync.Mutex
+	c          *websocket.Conn
+	requestid  uint64                 // last requestid sent
+	pending    map[string]chan []byte // requests waiting for a reply, by requestid
+	registered []subscription         // buckets passed to RegisterEvent and objects to Watch
+	logins     uint64                 // number of logins, a subscription is sent once per login
+	mirrors    []*Mirror              // buckets kept in memory
+	queue      *writeQueue            // offline queue, nil if not enabled
+	resumed    map[uint64]bool        // $seq received while a RESUME wait for its reply, nil otherwise
+	sized      bool                   // Ch was sized by the first ConnectContext
+
+	wmu sync.Mutex // websocket support only one concurrent writer
+	smu sync.Mutex // registrations are sent one at a time
+}
+
+/*NewClient create a client, call ConnectContext to connect it. A JsonBarn hold
+the state of its connection and must not be copied.
+*/
+func NewClient() *JsonBarn {
+	j := newJsonBarn()
+	return &j
 }
 
+/*New create a client.
 
-/* function to show debug info 
+Deprecated: use NewClient, a JsonBarn must not be copied once used so the
+value returned must only be used through its address.
 */
-func trace(msg string) {
-	if ShowTrace && len(msg) > 0 {
-		fmt.Println(msg)
+func New() JsonBarn {
+	return newJsonBarn()
+}
+
+func newJsonBarn() JsonBarn {
+	size := Bufsize
+	if size < 128 {
+		size = 128
 	}
+	return JsonBarn{Ch: make(chan []byte, size), NewDialer: &websocket.Dialer{}, Timeout: 30 * time.Second, pending: map[string]chan []byte{}}
+}
+
+/*State return the current state of the connection.
+ */
+func (j *JsonBarn) State() State {
+	return State(atomic.LoadInt32(&j.state))
 }
 
-/* create new item
+/*Dropped return the number of messages dropped because Ch was full.
+ */
+func (j *JsonBarn) Dropped() uint64 {
+	return j.dropped.Load()
+}
+
+/*Seq return the $seq of the last change received, the changes made after it
+are replayed when the client reconnect.
 */
-func New() JsonBarn {
-	if Bufsize <= 128 {
-		Bufsize = 128
+func (j *JsonBarn) Seq() uint64 {
+	return j.seq.Load()
+}
+
+/* observe remember the $seq of a broadcast. */
+func (j *JsonBarn) observe(message []byte) {
+
+	seq := gjson.GetBytes(message, "$seq").Uint()
+	if seq == 0 {
+		return
 	}
-	return JsonBarn{c: nil, exit: false, Ch: make(chan []byte, Bufsize), connected: false, loggedIn: false, NewDialer: &websocket.Dialer{}}
+	j.advance(seq)
+
+	j.mu.Lock()
+	if j.resumed != nil {
+		j.resumed[seq] = true
+	}
+	j.mu.Unlock()
 }
 
+/* advance set the last $seq received if seq is higher. */
+func (j *JsonBarn) advance(seq uint64) {
+	for {
+		last := j.seq.Load()
+		if seq <= last || j.seq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
 
+/*QueueDepth return the number of messages waiting in Ch.
+ */
+func (j *JsonBarn) QueueDepth() int {
+	return len(j.Ch)
+}
+
+func (j *JsonBarn) setState(state State, err error) {
+	atomic.StoreInt32(&j.state, int32(state))
+	if j.opts.OnState != nil {
+		j.opts.OnState(state, err)
+	}
+}
 
 func (j *JsonBarn) Send(msg string) error {
-	if j==nil {
+	if j == nil {
 		return errors.New("JsonBarnIsNil")
 	}
-	if !j.loggedIn {
+	switch j.State() {
+	case StateLoggedIn:
+		return j.writeMessage([]byte(msg))
+	case StateConnected:
 		return errors.New("NotLoggedIn")
 	}
-	if !j.connected {
-		return errors.New("NotConnected")
-	}
-	if j.c == nil {
+	return errors.New("NotConnected")
+}
+
+/* writeMessage send a message on the current connection
+ */
+func (j *JsonBarn) writeMessage(msg []byte) error {
+
+	j.mu.Lock()
+	c := j.c
+	j.mu.Unlock()
+
+	if c == nil {
 		return errors.New("ConnectionObjectNil")
 	}
-	return j.c.WriteMessage(websocket.TextMessage, []byte(msg))
-	
+
+	j.wmu.Lock()
+	defer j.wmu.Unlock()
+	return c.WriteMessage(websocket.TextMessage, msg)
 }
 
+/*Close the connection and wait until all the goroutines of the client are terminated.
+ */
 func (j *JsonBarn) Close() error {
-	if j==nil {
+	if j == nil {
 		return errors.New("JsonBarnIsNil")
 	}
-	j.c.Close()
-	j.loggedIn = false
-	j.connected = false
-	j.exit = true
+
+	j.mu.Lock()
+	cancel := j.cancel
+	j.cancel = nil
+	j.running = nil
+	j.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	j.wg.Wait()
 	return nil
 }
 
 // jsonBarn.Create
 func (j *JsonBarn) Connect(Host, Port, Path, username, password string, tlsConfig *tls.Config) error {
-	if j==nil {
+	return j.ConnectContext(context.Background(), Options{
+		Host:      Host,
+		Port:      Port,
+		Path:      Path,
+		Username:  username,
+		Password:  password,
+		TLSConfig: tlsConfig,
+	})
+}
+
+/*ConnectContext start a goroutine that connect and login to the server, the
+connection is reopen with an exponential backoff every time it is lost until
+ctx is cancelled, Close is called or the server refuse the credential.
+*/
+func (j *JsonBarn) ConnectContext(ctx context.Context, opts Options) error {
+	if j == nil {
 		return errors.New("JsonBarnIsNil")
 	}
-	if tlsConfig == nil {
-		j.NewDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	} else {
-		j.NewDialer.TLSClientConfig = tlsConfig
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	if j.cancel != nil {
+		j.mu.Unlock()
+		return errors.New("AlreadyConnected")
+	}
+	// readers of Ch would be left waiting on the old channel
+	if opts.BufferSize > 0 && opts.BufferSize != cap(j.Ch) {
+		if j.sized || len(j.Ch) > 0 {
+			j.mu.Unlock()
+			return errors.New("BufferSizeMismatch")
+		}
+		j.Ch = make(chan []byte, opts.BufferSize)
+	}
+	if opts.QueuePath != "" && j.queue == nil {
+		queue, err := openQueue(opts.QueuePath, opts.QueueMaxItems, opts.QueueMaxBytes, opts.logger())
+		if err != nil {
+			j.mu.Unlock()
+			return err
+		}
+		j.queue = queue
+	}
+	j.sized = true
+	ctx, cancel := context.WithCancel(ctx)
+	j.cancel = cancel
+	j.running = ctx
+	j.opts = opts
+	j.mu.Unlock()
+
+	j.NewDialer.TLSClientConfig = tlsConfig
+	if opts.Proxy != nil {
+		j.NewDialer.Proxy = opts.Proxy
+	} else if j.NewDialer.Proxy == nil {
+		j.NewDialer.Proxy = http.ProxyFromEnvironment
 	}
 
+	j.wg.Add(1)
+	go j.run(ctx, cancel)
+
+	return nil
+}
+
+/* run connect to the server until the context is cancelled, the server refuse
+the credential or the protocol version. ConnectContext can be called again once
+it returned.
+*/
+func (j *JsonBarn) run(ctx context.Context, cancel context.CancelFunc) {
+
+	defer j.wg.Done()
+	defer func() {
+		cancel()
+
+		// Close or a new ConnectContext may have replaced them already
+		j.mu.Lock()
+		if j.running == ctx {
+			j.cancel = nil
+			j.running = nil
+		}
+		j.mu.Unlock()
+	}()
+
+	backoff := j.opts.MinBackoff
+
+	for {
+		loggedIn, err := j.session(ctx)
+
+		if ctx.Err() != nil || errors.Is(err, ErrLoginFailed) || errors.Is(err, ErrProtocolVersion) {
+			return
+		}
+
+		if loggedIn {
+			backoff = j.opts.MinBackoff
+		}
+
+		// wait between backoff/2 and backoff before trying again
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		j.log().Info("jsonbarn: reconnecting", "delay", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > j.opts.MaxBackoff {
+			backoff = j.opts.MaxBackoff
+		}
+	}
+}
+
+/* session open one connection, login and read messages until the connection is lost.
+ */
+func (j *JsonBarn) session(ctx context.Context) (loggedIn bool, err error) {
+
+	u := url.URL{Scheme: "wss", Host: j.opts.Host + ":" + j.opts.Port, Path: j.opts.Path}
+	if j.opts.AllowInsecureWS {
+		u.Scheme = "ws"
+	}
+
+	j.setState(StateConnecting, nil)
+	j.log().Debug("jsonbarn: connecting", "url", u.String())
+
+	c, _, err := j.NewDialer.DialContext(ctx, u.String(), j.opts.Header)
+	if err != nil {
+		j.setState(StateDisconnected, err)
+		return false, err
+	}
+
+	j.mu.Lock()
+	j.c = c
+	j.mu.Unlock()
+
+	// stop the goroutines started for this connection when it end
+	sctx, scancel := context.WithCancel(ctx)
+
+	// close the connection when the context is cancelled to unblock ReadMessage
+	done := make(chan struct{})
+	j.wg.Add(1)
 	go func() {
+		defer j.wg.Done()
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		c.Close()
+	}()
 
-		var err error
-		u := url.URL{Scheme: "wss", Host: Host + ":" + Port, Path: Path}
+	defer func() {
+		close(done)
+		scancel()
 
-		for {
-			if j.exit {
-				break
+		j.mu.Lock()
+		j.c = nil
+		pending := j.pending
+		j.pending = map[string]chan []byte{}
+		j.mu.Unlock()
+
+		// requests waiting for a reply will never get one
+		for _, reply := range pending {
+			reply <- nil
+		}
+
+		// the client stop after a refused login, the state stay login failed
+		if j.State() != StateLoginFailed {
+			j.setState(StateDisconnected, err)
+		}
+	}()
+
+	j.setState(StateConnected, nil)
+
+	j.log().Debug("jsonbarn: sending login", "username", j.opts.Username)
+	m, err := json.Marshal(&Command{Action: "LOGIN", Username: j.opts.Username, Password: j.opts.Password, Version: ProtocolVersion})
+	if err != nil {
+		return false, err
+	}
+	if err = j.writeMessage(m); err != nil {
+		return false, err
+	}
+
+	for {
+		var message []byte
+
+		_, message, err = c.ReadMessage()
+		if err != nil {
+			return loggedIn, err
+		}
+
+		if j.opts.TraceMessages {
+			j.log().Debug("jsonbarn: received", "message", string(message))
+		}
+
+		// validate json
+		if !gjson.ValidBytes(message) {
+			continue
+		}
+
+		action := gjson.GetBytes(message, "action").String()
+
+		// nothing else is sent before the login is accepted, a message is
+		// the server refusing the login attempt i.e. too many attempts.
+		if !loggedIn && action == "message" {
+			err = errors.New(gjson.GetBytes(message, "message").String())
+			return loggedIn, err
+		}
+
+		if action == "login" {
+			if err = checkLogin(message); err != nil {
+				j.setState(StateLoginFailed, err)
+				return loggedIn, err
 			}
+			j.log().Info("jsonbarn: logged in", "username", j.opts.Username)
+			loggedIn = true
+			j.mu.Lock()
+			j.logins++
+			j.mu.Unlock()
+			j.setState(StateLoggedIn, nil)
 
-			if !j.connected {
-				j.loggedIn = false
-				for {
-					trace("connecting " + u.String())
-					j.c, _, err = j.NewDialer.Dial(u.String(), nil)
-					if err != nil {
-						time.Sleep(time.Second)
-					} else {
-						j.connected = true
-						trace("sending login " + username + " " + password)
-						m := `{"$jsonbarn_action": "LOGIN", "$jsonbarn_username": "` + username + `", "$jsonbarn_password": "` + password + `"}`
-						err = j.c.WriteMessage(websocket.TextMessage, []byte(m))
-						break
-					}
+			// can't wait for the replies from this goroutine, it read them
+			j.wg.Add(1)
+			go func() {
+				defer j.wg.Done()
+				j.resubscribe(sctx)
+				if j.queue != nil {
+					j.drainQueue(sctx)
 				}
-			}
+			}()
+		}
 
+		// reply to a request made with the typed api
+		if j.dispatch(message) {
+			continue
+		}
 
-			_, message, err := j.c.ReadMessage()
-			if err != nil {
-				j.connected = false
-				j.loggedIn = false
-			} else {
-				
-				msg := string(message)
-				trace("rx " + string(message))
-						
-				// validate json
-				if !gjson.Valid(msg) {
-					continue
-				}
-				value := gjson.Get(msg, "$login")
-				if value.Exists() {
-					trace("logged in!")
-					j.loggedIn = true
-				}
-				trace("sending message into rx channel ")
-		
-				for {
-					select {
-						case  j.Ch <- message:
-							break
-						default:
-							// oups buffer is full we have to wait until it's not 
-							time.Sleep(100 * time.Nanosecond)
-					}
-				}
-    
+		j.observe(message)
+		j.notifyMirrors(message)
+
+		// the server dropped broadcasts, the mirrors must be reloaded
+		if action == "resync" {
+			j.wg.Add(1)
+			go func() {
+				defer j.wg.Done()
+				j.syncMirrors()
+			}()
+		}
+
+		if err = j.deliver(ctx, message); err != nil {
+			return loggedIn, err
+		}
+	}
+}
+
+/* deliver put a message in the receive channel according to the backpressure
+policy.
+*/
+func (j *JsonBarn) deliver(ctx context.Context, message []byte) error {
+
+	select {
+	case j.Ch <- message:
+		return nil
+	default:
+	}
+
+	switch j.opts.Backpressure {
+
+	case BackpressureDropNewest:
+		j.dropped.Add(1)
+		j.log().Warn("jsonbarn: receive channel full, message dropped")
+		return nil
+
+	case BackpressureDropOldest:
+		for {
+			select {
+			case j.Ch <- message:
+				return nil
+			default:
+			}
+			// the reader may have emptied the channel in between
+			select {
+			case <-j.Ch:
+				j.dropped.Add(1)
+				j.log().Warn("jsonbarn: receive channel full, oldest message dropped")
+			default:
 			}
 		}
-	}()
 
-	return nil
+	case BackpressureDisconnect:
+		j.dropped.Add(1)
+		return ErrReceiveChannelFull
+	}
+
+	select {
+	case j.Ch <- message:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+/* checkLogin validate the reply of the server to the LOGIN command.
+ */
+func checkLogin(message []byte) error {
+
+	version := gjson.GetBytes(message, "version")
+	if !version.Exists() || version.Int() != ProtocolVersion {
+		return fmt.Errorf("%w: server use version %d, client use version %d", ErrProtocolVersion, version.Int(), ProtocolVersion)
+	}
+
+	if gjson.GetBytes(message, "result").String() != "success" {
+		return fmt.Errorf("%w: %s", ErrLoginFailed, gjson.GetBytes(message, "error").String())
+	}
+	return nil
 }
@@ -13,6 +13,10 @@ var Jsonbarn = (function(){
             this.logged = false;
             this.registerevents =  [];
 	        this.serversocket = null;
+            this.version = 1;       /* protocol version spoken by this client */
+            this.requestid = 0;
+            this.pending = {};
+            this.seq = 0;           /* $seq of the last change received, use by resume */
             
             /* Events */
             this.onconnect = null;
@@ -30,6 +34,11 @@ var Jsonbarn = (function(){
             this.onindexes = null;
             this.onregisterevent = null;
             this.onunregisterevent = null;
+            this.onwatch = null;
+            this.onunwatch = null;
+            this.onresync = null;
+            this.onratelimited = null;
+            this.onpresence = null;
             
            };
         
@@ -56,6 +65,34 @@ Jsonbarn.prototype.queuemsg = function(msg) {
   
 }
 
+/* Send a command object to the server and call callback(error, response) once the 
+reply to this command is received, error is set if the server do not reply within 
+timeout milliseconds or if the server reply with a message.  The reply is matched with 
+the command using the requestid echoed by the server, no other event is fired for it.
+*/
+Jsonbarn.prototype.call = function(command, timeout, callback) {
+
+    var self = this;
+    if (self.serversocket == null || self.connected == false) {
+        callback("There is no active connection.", null);
+        return;     
+    }
+
+    self.requestid++;
+    var id = "" + self.requestid;
+    command.requestid = id;
+
+    self.pending[id] = {
+        callback: callback,
+        timer: setTimeout(function() {
+            delete self.pending[id];
+            callback("Timeout", null);
+        }, timeout)
+    };
+
+    self.queuemsg(JSON.stringify(command));
+}
+
 Jsonbarn.prototype.error = function(msg) {
         var self = this;
         if (typeof self.onerror === "function") {
@@ -90,13 +127,17 @@ Jsonbarn.prototype.getusers = function(){
     self.queuemsg("{\"action\":\"GETUSERS\" }");
 };
 
-Jsonbarn.prototype.registerevent = function(bucketname){
+Jsonbarn.prototype.registerevent = function(bucketname, conditions){
     var self = this;
     if (self.serversocket == null || self.connected == false) {
         self.error("There is no active connection.");   
         return;     
     }
-    self.queuemsg("{\"action\":\"REGISTEREVENT\", \"bucketname\":\"" + bucketname + "\" }");
+    var command = {action: "REGISTEREVENT", bucketname: bucketname};
+    if (conditions) {
+        command.data = conditions;
+    }
+    self.queuemsg(JSON.stringify(command));
 };
 
 Jsonbarn.prototype.getconfig = function(){
@@ -126,13 +167,91 @@ Jsonbarn.prototype.getlogs = function(startime, endtime){
     self.queuemsg("{\"action\":\"LOGS\", \"key\":\"" + startime  + "\", \"maxkey\":\"" + endtime + "\" }");
 };
 
-Jsonbarn.prototype.unregisterevent = function(bucketname){
+Jsonbarn.prototype.unregisterevent = function(bucketname, conditions){
     var self = this;
     if (self.serversocket == null || self.connected == false) {
         self.error("There is no active connection.");        
         return;     
     }
-	self.queuemsg("{\"action\":\"UNREGISTEREVENT\", \"bucketname\":\"" + bucketname + "\" }");
+    var command = {action: "UNREGISTEREVENT", bucketname: bucketname};
+    if (conditions) {
+        command.data = conditions;
+    }
+	self.queuemsg(JSON.stringify(command));
+};
+
+/* replay the changes made after seq to the buckets registered, use this.seq
+   after registering again the buckets of a new connection */
+Jsonbarn.prototype.resume = function(seq){
+    var self = this;
+    if (self.serversocket == null || self.connected == false) {
+        self.error("There is no active connection.");
+        return;
+    }
+    if (seq == null || seq == undefined) {
+        seq = self.seq;
+    }
+    self.queuemsg(JSON.stringify({action: "RESUME", key: String(seq)}));
+};
+
+/* give a change to the insert, update and delete events */
+Jsonbarn.prototype.change = function(item){
+    var self = this;
+    if (item.$seq > self.seq) {
+        self.seq = item.$seq;
+    }
+    if (item.action == "UPDATE" && typeof self.onupdate === "function") {
+        self.onupdate(item);
+    } else if (item.action == "DELETE" && typeof self.ondelete === "function") {
+        self.ondelete(item);
+    } else if (item.action == "INSERT" && typeof self.oninsert === "function") {
+        self.oninsert(item);
+    }
+};
+
+/* ids is a $id or an array of $id */
+Jsonbarn.prototype.watch = function(bucketname, ids){
+    var self = this;
+    if (self.serversocket == null || self.connected == false) {
+        self.error("There is no active connection.");
+        return;
+    }
+    var command = {action: "WATCH", bucketname: bucketname};
+    if (Array.isArray(ids)) {
+        command.data = ids;
+    } else {
+        command.key = ids;
+    }
+    self.queuemsg(JSON.stringify(command));
+};
+
+Jsonbarn.prototype.unwatch = function(bucketname, ids){
+    var self = this;
+    if (self.serversocket == null || self.connected == false) {
+        self.error("There is no active connection.");
+        return;
+    }
+    var command = {action: "UNWATCH", bucketname: bucketname};
+    if (Array.isArray(ids)) {
+        command.data = ids;
+    } else {
+        command.key = ids;
+    }
+    self.queuemsg(JSON.stringify(command));
+};
+
+/* bucketname empty for the users online, listen is "on", "off" or undefined */
+Jsonbarn.prototype.presence = function(bucketname, listen){
+    var self = this;
+    if (self.serversocket == null || self.connected == false) {
+        self.error("There is no active connection.");
+        return;
+    }
+    var command = {action: "PRESENCE", bucketname: bucketname || ""};
+    if (listen) {
+        command.key = listen;
+    }
+    self.queuemsg(JSON.stringify(command));
 };
 
 
@@ -166,7 +285,7 @@ Jsonbarn.prototype.login = function(username, password){
 	    return
 	}
 
-    self.queuemsg('{"action": "LOGIN", "username":"' + username + '", "password":"' + password + '"}');    
+    self.queuemsg(JSON.stringify({"action": "LOGIN", "username": username, "password": password, "version": self.version}));    
 };
 
 Jsonbarn.prototype.logout = function() {
@@ -447,9 +566,30 @@ Jsonbarn.prototype.connect = function(host) {
                     showAlert(e.data)        
                 }
 
+                /* reply to a command sent with call() */
+                if (e.response.requestid != undefined) {
+
+                    var request = self.pending[e.response.requestid];
+                    if (request != undefined) {
+                        clearTimeout(request.timer);
+                        delete self.pending[e.response.requestid];
+                        if (e.response.action == "message") {
+                            request.callback(e.response.message, e.response);
+                        } else {
+                            request.callback(null, e.response);
+                        }
+                    }
+                    return false;
+                }
+
 			    if (e.response.action == "login") {
 
-					if (e.response.result == "success") {
+					if (e.response.version != self.version) {
+
+                        self.error("Server use protocol version " + e.response.version + ", client use version " + self.version);
+                        result = false;
+
+                    } else if (e.response.result == "success") {
 
                         self.username = e.response.username;
                         self.logged = true;
@@ -474,8 +614,9 @@ Jsonbarn.prototype.connect = function(host) {
                             self.onlogout();
                         }
                 
-                } else if (e.response.action == "message") {
+                } else if (e.response.action == "message" || e.response.status === true && (e.response.action == "putconfig" || e.response.action == "indexcreate" || e.response.action == "indexdrop" || e.response.action == "emailalert")) {
 
+                    // the success of a command is displayed like any message
                     if (typeof self.onmessage === "function") {
                         self.onmessage(e.response.message);
                     }
@@ -494,22 +635,39 @@ Jsonbarn.prototype.connect = function(host) {
                         self.onstats(e.response.server, e.response.database);
                     }
              					
-    		    } else if (e.response.action == "UPDATE") {  
+    		    } else if (e.response.action == "UPDATE" || e.response.action == "DELETE" || e.response.action == "INSERT") {
 
-                    if (typeof self.onupdate === "function") {
-                        self.onupdate(e.response);
+                    self.change(e.response);
+
+          		} else if (e.response.action == "resume") {
+
+                    if (e.response.status) {
+                        e.response.items.forEach(function(item) {
+                            self.change(item);
+                        });
+                        if (e.response.seq > self.seq) {
+                            self.seq = e.response.seq;
+                        }
+                    } else if (e.response.resync) {
+                        if (typeof self.onresync === "function") {
+                            self.onresync();
+                        }
+                    } else {
+                        self.error(e.response.error);
                     }
 
-          		} else if (e.response.action == "DELETE") {
+          		} else if (e.response.action == "ratelimited") {
 
-                    if (typeof self.ondelete === "function") {
-                        self.ondelete(e.response);
+                    if (typeof self.onratelimited === "function") {
+                        self.onratelimited(e.response.command, e.response.retryafter);
+                    } else {
+                        self.error(e.response.message);
                     }
-        
-          		} else if (e.response.action == "INSERT") {
 
-                    if (typeof self.oninsert === "function") {
-                        self.oninsert(e.response);
+          		} else if (e.response.action == "resync") {
+
+                    if (typeof self.onresync === "function") {
+                        self.onresync();
                     }
 
 			    } else if (e.response.action == "gettime") {
@@ -543,6 +701,25 @@ Jsonbarn.prototype.connect = function(host) {
                     if (typeof self.onunregisterevent === "function") {
                         self.onunregisterevent(e.response.bucketname);
                     }
+
+		    	} else if (e.response.action == "watch") {
+
+                    if (typeof self.onwatch === "function") {
+                        self.onwatch(e.response.bucketname, e.response.ids, e.response.status, e.response.error);
+                    }
+
+		    	} else if (e.response.action == "unwatch") {
+
+                    if (typeof self.onunwatch === "function") {
+                        self.onunwatch(e.response.bucketname, e.response.ids, e.response.status, e.response.error);
+                    }
+
+		    	} else if (e.response.action == "presence") {
+
+                    // an event has no users, a reply to presence() has no event
+                    if (typeof self.onpresence === "function") {
+                        self.onpresence(e.response.bucketname, e.response.users, e.response.event, e.response.username);
+                    }
 				
 
 			}
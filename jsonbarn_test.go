@@ -0,0 +1,100 @@
+package jsonbarn_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/marcgauthier/jsonbarn"
+)
+
+func TestLoginFailed(t *testing.T) {
+	srv := newServer(t)
+
+	states := make(chan error, 10)
+	opts := srv.Options("ann", "wrong")
+	opts.OnState = func(state jsonbarn.State, err error) {
+		if state == jsonbarn.StateLoginFailed {
+			states <- err
+		}
+	}
+
+	c := jsonbarn.NewClient()
+	if err := c.ConnectContext(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case err := <-states:
+		if !errors.Is(err, jsonbarn.ErrLoginFailed) {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("login not refused")
+	}
+
+	// the client stopped and report why
+	time.Sleep(100 * time.Millisecond)
+	if c.State() != jsonbarn.StateLoginFailed {
+		t.Fatal(c.State())
+	}
+
+	// it can connect again with the right password
+	opts.Password = "secret"
+	waitFor(t, "stop", func() bool {
+		return c.ConnectContext(context.Background(), opts) == nil
+	})
+	receive(t, c, "login")
+	if c.State() != jsonbarn.StateLoggedIn {
+		t.Fatal(c.State())
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	srv := newServer(t)
+
+	opts := srv.Options("ann", "secret")
+	opts.BufferSize = 4
+	c := connect(t, opts)
+	ch := c.Ch
+	if cap(ch) != 4 {
+		t.Fatal("cap", cap(ch))
+	}
+	c.Close()
+
+	// Ch is not replaced, a reader would wait on the old channel
+	opts.BufferSize = 8
+	if err := c.ConnectContext(context.Background(), opts); err == nil || err.Error() != "BufferSizeMismatch" {
+		t.Fatal(err)
+	}
+
+	opts.BufferSize = 0
+	if err := c.ConnectContext(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, c, "login")
+	if c.Ch != ch {
+		t.Fatal("Ch replaced")
+	}
+}
+
+func TestNewDeprecated(t *testing.T) {
+	srv := newServer(t)
+
+	size := jsonbarn.Bufsize
+	defer func() { jsonbarn.Bufsize = size }()
+	jsonbarn.Bufsize = 256
+
+	// the value returned by New is used through its address
+	c := jsonbarn.New()
+	if cap(c.Ch) != 256 {
+		t.Fatal("cap", cap(c.Ch))
+	}
+	if err := c.ConnectContext(context.Background(), srv.Options("ann", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	receive(t, &c, "login")
+}
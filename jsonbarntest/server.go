@@ -0,0 +1,1247 @@
+/*Package jsonbarntest provide an in-memory JSONBARN server to test code that use
+the Go client without PostgreSQL.
+
+The server speak the same websocket actions than Client.read in the models
+package: LOGIN, LOGOUT, GETTIME, READALL, READONE, READFIND, READRANGE, QUERY,
+INSERT, UPDATE, DELETE, REGISTEREVENT, UNREGISTEREVENT, WATCH, UNWATCH,
+RESUME, PRESENCE, INDEXCREATE and INDEXDROP. Replies, errors and
+broadcasts use the same JSON than the real server and the rights of the users
+are checked the same way, a user with the "admin" right can do everything.
+
+	srv := jsonbarntest.NewServer(jsonbarntest.User{
+		Name:     "bob",
+		Password: "secret",
+		Rights:   []string{"INCIDENTS-read", "INCIDENTS-insert"},
+	})
+	defer srv.Close()
+
+	client := jsonbarn.NewClient()
+	client.ConnectContext(ctx, srv.Options("bob", "secret"))
+
+Other actions (users, configuration, logs, list of indexes and email alerts)
+are answered with a message saying they are not supported.
+*/
+package jsonbarntest
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/tidwall/gjson"
+)
+
+/*ProtocolVersion version of the websocket protocol spoken by the server.
+ */
+const ProtocolVersion = 1
+
+/*Path of the websocket on the test server.
+ */
+const Path = "/wss/"
+
+/*User allowed to login on the test server, Rights contain the name of the
+rights i.e. "INCIDENTS-read" or "admin".
+*/
+type User struct {
+	Name     string
+	Password string
+	Rights   []string
+	Settings json.RawMessage
+}
+
+/*Server is an in-memory JSONBARN server, it is safe for concurrent use.
+ */
+type Server struct {
+	*httptest.Server
+
+	upgrader websocket.Upgrader
+
+	mu      sync.Mutex
+	users   map[string]*User
+	items   map[string]json.RawMessage // by $id
+	order   []string                   // $id in insertion order, reads return items in this order
+	clients map[*client]bool
+	timers  []*time.Timer   // defered commands
+	seq     uint64          // $seq of the last change
+	changes []*change       // changes kept for RESUME
+	drop    map[string]int  // replies not sent by action, see DropReplies
+	indexes map[string]bool // names of the indexes created
+}
+
+/* client is one websocket connection.
+ */
+type client struct {
+	ws *websocket.Conn
+
+	wmu sync.Mutex // websocket support only one concurrent writer
+
+	// only accessed by the goroutine reading the connection and the
+	// broadcasts, protected by Server.mu
+	username       string
+	password       string
+	registerEvents []registration
+	watching       map[watch]int   // number of WATCH for each object
+	listening      map[string]bool // presence events by lowercase bucket name, "" for join and leave
+}
+
+/* watch is an object passed to WATCH, bucketname is lowercase.
+ */
+type watch struct {
+	bucketname string
+	id         string
+}
+
+/* registration made with REGISTEREVENT, filter is nil for all the changes.
+ */
+type registration struct {
+	bucketname string
+	key        string
+	filter     query
+}
+
+/* roster users online by "" and users registered by lowercase bucket name,
+bucketnames keep the name of the registration.
+*/
+type roster struct {
+	users       map[string]map[string]bool
+	bucketnames map[string]string
+}
+
+/* delivery message to send to a client once s.mu is released.
+ */
+type delivery struct {
+	client  *client
+	message []byte
+}
+
+/* change made to an item, previous is the item before an UPDATE.
+ */
+type change struct {
+	seq      uint64
+	message  []byte
+	previous []byte
+}
+
+/* command sent by the client, same structure than models.MsgClientCmd.
+ */
+type command struct {
+	Action      string          `json:"action"`
+	Username    string          `json:"username"`
+	Password    string          `json:"password"`
+	Bucketname  string          `json:"bucketname"`
+	SearchField string          `json:"searchfield"`
+	Key         string          `json:"key"`
+	MaxKey      string          `json:"maxkey"`
+	Field       string          `json:"field"`
+	Defered     uint64          `json:"defered"`
+	Data        json.RawMessage `json:"data"`
+	RequestID   string          `json:"requestid"`
+	Version     int             `json:"version"`
+}
+
+/*NewServer start a test server that accept ws:// connections.
+ */
+func NewServer(users ...User) *Server {
+	s := newServer(users)
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+/*NewTLSServer start a test server that accept wss:// connections, Options set
+the certificate of the server as the CA to trust.
+*/
+func NewTLSServer(users ...User) *Server {
+	s := newServer(users)
+	s.Server = httptest.NewTLSServer(s)
+	return s
+}
+
+func newServer(users []User) *Server {
+	s := &Server{
+		users:   map[string]*User{},
+		items:   map[string]json.RawMessage{},
+		clients: map[*client]bool{},
+		indexes: map[string]bool{},
+	}
+	s.upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	for _, u := range users {
+		s.AddUser(u)
+	}
+	return s
+}
+
+/*Close disconnect all the clients and stop the server.
+ */
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, t := range s.timers {
+		t.Stop()
+	}
+	s.timers = nil
+	s.mu.Unlock()
+
+	s.Disconnect()
+	s.Server.Close()
+}
+
+/*Options return the options to connect a client to the server.
+ */
+func (s *Server) Options(username, password string) jsonbarn.Options {
+
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+
+	opts := jsonbarn.Options{
+		Host:       host,
+		Port:       port,
+		Path:       Path,
+		Username:   username,
+		Password:   password,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	}
+
+	if s.TLS == nil {
+		opts.AllowInsecureWS = true
+	} else {
+		opts.RootCAs = x509.NewCertPool()
+		opts.RootCAs.AddCert(s.Certificate())
+	}
+	return opts
+}
+
+/*AddUser add or replace a user.
+ */
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[strings.ToLower(u.Name)] = &u
+}
+
+/*Disconnect close the connection of all the clients, i.e. to test reconnect.
+ */
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.ws.Close()
+	}
+}
+
+/*DropReplies execute the next n commands of the action without replying to
+them, i.e. to test a client that send a command again when the reply is lost.
+*/
+func (s *Server) DropReplies(action string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drop == nil {
+		s.drop = map[string]int{}
+	}
+	s.drop[action] = n
+}
+
+/* dropReply return true if the reply to the action must not be sent. */
+func (s *Server) dropReply(action string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drop[action] <= 0 {
+		return false
+	}
+	s.drop[action]--
+	return true
+}
+
+/*Put add or replace an item without checking rights or sending a broadcast,
+use it to prepare the content of a bucket. $id is created if missing and
+$bucketname is set. Return the $id of the item.
+*/
+func (s *Server) Put(bucketname string, item interface{}) (string, error) {
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return "", err
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+
+	id, _ := fields["$id"].(string)
+	if id == "" {
+		id = newUUID()
+	}
+	fields["$id"] = id
+	fields["$bucketname"] = bucketname
+
+	if data, err = json.Marshal(fields); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.store(id, data)
+	s.mu.Unlock()
+	return id, nil
+}
+
+/*Items return all the items of a bucket.
+ */
+func (s *Server) Items(bucketname string) []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bucket(bucketname)
+}
+
+/*ServeHTTP upgrade the request to a websocket connection.
+ */
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &client{ws: ws}
+
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		before := s.present()
+		delete(s.clients, c)
+		events := s.presenceEvents(before)
+		s.mu.Unlock()
+		ws.Close()
+		for _, e := range events {
+			e.client.send(e.message)
+		}
+	}()
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		cmd := command{}
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			c.send(prepMessage("JSON OBJECT provided was invalid: " + err.Error()))
+			continue
+		}
+
+		reply, broadcast, events := s.handle(c, &cmd)
+
+		if s.dropReply(cmd.Action) {
+			reply = nil
+			cmd.RequestID = ""
+		}
+
+		if cmd.RequestID != "" {
+			if reply == nil {
+				reply = []byte(`{"action":"ack"}`)
+			}
+			reply = setRequestID(reply, cmd.RequestID)
+		}
+
+		if reply != nil {
+			c.send(reply)
+		}
+		if broadcast != nil {
+			s.broadcast(broadcast)
+		}
+		for _, e := range events {
+			e.client.send(e.message)
+		}
+	}
+}
+
+/* handle execute a command and return the reply, the broadcast and the
+presence events to send.
+*/
+func (s *Server) handle(c *client, cmd *command) (reply []byte, broadcast *change, events []delivery) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := s.present()
+	defer func() {
+		events = s.presenceEvents(before)
+	}()
+
+	// overwrite any provided credential with the proper credential
+	if cmd.Action != "LOGIN" {
+		cmd.Username = c.username
+		cmd.Password = c.password
+	}
+
+	switch cmd.Action {
+
+	case "LOGIN":
+		reply = s.login(c, cmd)
+
+	case "LOGOUT":
+		c.username = ""
+		c.password = ""
+		reply = []byte(`{ "action":"logout"}`)
+
+	case "GETTIME":
+		reply = []byte(`{"action": "gettime", "time":` + strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 6, 64) + `}`)
+
+	case "READALL", "READONE", "READFIND", "READRANGE", "QUERY":
+		reply = s.read(cmd)
+
+	case "INSERT":
+		reply, broadcast = s.insert(cmd, false)
+
+	case "UPDATE":
+		reply, broadcast = s.update(cmd, false)
+
+	case "DELETE":
+		reply, broadcast = s.delete(cmd, false)
+
+	case "REGISTEREVENT", "UNREGISTEREVENT":
+		reply = s.registration(c, cmd)
+
+	case "WATCH", "UNWATCH":
+		reply = s.watch(c, cmd)
+
+	case "RESUME":
+		reply = s.resume(c, cmd)
+
+	case "PRESENCE":
+		reply = s.presence(c, cmd)
+
+	case "INDEXCREATE", "INDEXDROP":
+		reply = s.index(cmd)
+
+	case "SETUSERSETTING", "GETCONFIG", "PUTCONFIG", "GETUSERS", "LOGS", "INDEXLIST", "EMAILALERT":
+		reply = prepMessage(cmd.Action + " is not supported by the test server")
+
+	default:
+		// same as the server, an unknown action receive an error message
+		return prepMessage("Unknown action " + cmd.Action), nil, nil
+	}
+
+	return reply, broadcast, nil
+}
+
+func (s *Server) login(c *client, cmd *command) []byte {
+
+	version := strconv.Itoa(ProtocolVersion)
+	username := strconv.Quote(cmd.Username)
+
+	if cmd.Version != 0 && cmd.Version != ProtocolVersion {
+		return []byte(`{ "action":"login", "result":"failed", "username":` + username + `, "version":` + version +
+			`, "error":"Unsupported protocol version ` + strconv.Itoa(cmd.Version) + `, server use version ` + version + `"}`)
+	}
+
+	u := s.verify(cmd.Username, cmd.Password)
+	if u == nil {
+		return []byte(`{ "action":"login", "result":"failed", "username":` + username + `, "version":` + version +
+			`, "error":` + strconv.Quote("Invalid or incorrect password for username "+cmd.Username) + `}`)
+	}
+
+	c.username = cmd.Username
+	c.password = cmd.Password
+
+	settings := string(u.Settings)
+	if settings == "" {
+		settings = "{}"
+	}
+	rights, _ := json.Marshal(u.Rights)
+	if u.Rights == nil {
+		rights = []byte("[]")
+	}
+
+	return []byte(`{ "action":"login", "result":"success", "settings":` + settings + `, "rights":` + string(rights) +
+		`, "username":` + username + `, "version":` + version + `}`)
+}
+
+/* verify return the user if the password is correct.
+ */
+func (s *Server) verify(username, password string) *User {
+	if password == "" {
+		return nil
+	}
+	u := s.users[strings.ToLower(username)]
+	if u == nil || u.Password != password {
+		return nil
+	}
+	return u
+}
+
+/* hasRight check the password and the right of a user, see UserHasRight.
+ */
+func (s *Server) hasRight(username, password, rightname string) bool {
+	u := s.verify(username, password)
+	if u == nil {
+		return false
+	}
+	for _, r := range u.Rights {
+		if strings.EqualFold(r, "admin") || strings.EqualFold(r, rightname) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) read(cmd *command) []byte {
+
+	if !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-read") {
+		return prepMessage("Internal error or you do not have access to " + cmd.Bucketname)
+	}
+
+	var match func(item []byte) bool
+
+	switch cmd.Action {
+
+	case "READALL":
+		match = func(item []byte) bool { return true }
+
+	case "READONE", "READFIND":
+		match = func(item []byte) bool { return compare(item, cmd.SearchField, cmd.Field, cmd.Key) == 0 }
+
+	case "READRANGE":
+		match = func(item []byte) bool {
+			low := compare(item, cmd.SearchField, cmd.Field, cmd.Key)
+			high := compare(item, cmd.SearchField, cmd.Field, cmd.MaxKey)
+			return (low == 0 || low == 1) && (high == 0 || high == -1)
+		}
+
+	case "QUERY":
+		conditions, ok := parseQuery(cmd.Data)
+		if !ok {
+			return prepMessage("No query could be build")
+		}
+		match = func(item []byte) bool { return conditions.match(item) }
+	}
+
+	items := []string{}
+	for _, item := range s.bucket(cmd.Bucketname) {
+		if match(item) {
+			items = append(items, string(item))
+			if cmd.Action == "READONE" {
+				break
+			}
+		}
+	}
+
+	return []byte(`{"action":"read", "bucketname": ` + strconv.Quote(cmd.Bucketname) + `, "items" : [` + strings.Join(items, ",") + `]}`)
+}
+
+func (s *Server) insert(cmd *command, defered bool) (reply []byte, broadcast *change) {
+
+	if !defered {
+		if !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-insert") {
+			return prepMessage("Access denined."), nil
+		}
+		if s.deferCommand(cmd) {
+			return nil, nil
+		}
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(cmd.Data, &fields); err != nil {
+		return prepMessage("Database Error: " + err.Error()), nil
+	}
+
+	id := cmd.Key
+	if !uuidv4.MatchString(id) {
+		id = newUUID()
+	}
+
+	// like the server an INSERT sent again change nothing
+	if _, ok := s.items[id]; ok {
+		return nil, nil
+	}
+
+	// status can only be set with the statuschange right
+	for _, name := range []string{"itemstatus", "status"} {
+		if _, ok := fields[name]; ok && !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-statuschange") {
+			fields[name] = "30"
+		}
+	}
+
+	now := uint64(time.Now().Unix())
+	fields["$id"] = id
+	fields["$bucketname"] = cmd.Bucketname
+	fields["$createdby"] = cmd.Username
+	fields["$updatedby"] = cmd.Username
+	fields["$createdonnetwork"] = "00000000-0000-0000-0000-000000000000"
+	fields["$createdonserver"] = ""
+	fields["$createdtime"] = now
+	fields["$updatedtime"] = now
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return prepMessage("Database Error: " + err.Error()), nil
+	}
+
+	s.store(id, data)
+	return nil, s.record(&change{message: withAction(data, "INSERT")})
+}
+
+func (s *Server) update(cmd *command, defered bool) (reply []byte, broadcast *change) {
+
+	if !defered {
+		if !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-update") {
+			return prepMessage("Access denined."), nil
+		}
+		if s.deferCommand(cmd) {
+			return nil, nil
+		}
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(cmd.Data, &fields); err != nil {
+		return prepMessage("Error  " + err.Error()), nil
+	}
+
+	_, status := fields["$status"]
+	_, itemstatus := fields["$itemstatus"]
+	if (status || itemstatus) && !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-statuschange") {
+		return prepMessage("Access denied you can't change the status value."), nil
+	}
+
+	// like the UPDATE statement nothing happen if the item does not exist
+	previous, ok := s.items[cmd.Key]
+	if !ok {
+		return nil, nil
+	}
+
+	// an update without the status keep the status saved
+	if !status && !itemstatus {
+		saved := map[string]json.RawMessage{}
+		json.Unmarshal(previous, &saved)
+		for _, name := range []string{"$status", "$itemstatus"} {
+			if value, ok := saved[name]; ok {
+				fields[name] = value
+			}
+		}
+	}
+
+	if b, _ := fields["$bucketname"].(string); b == "" {
+		fields["$bucketname"] = cmd.Bucketname
+	}
+	fields["$updatedby"] = cmd.Username
+	fields["$updatedtime"] = uint64(time.Now().Unix())
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return prepMessage("Error  " + err.Error()), nil
+	}
+
+	s.items[cmd.Key] = data
+	return nil, s.record(&change{message: withAction(data, "UPDATE"), previous: previous})
+}
+
+/* index create or drop an index, only the name is kept. */
+func (s *Server) index(cmd *command) []byte {
+
+	if cmd.Action == "INDEXCREATE" {
+		if !s.hasRight(cmd.Username, cmd.Password, "createindex") {
+			return prepMessage("You do not have access rights to create index")
+		}
+		s.indexes[cmd.Key] = true
+		return prepStatus("indexcreate", "Index created")
+	}
+
+	if !s.hasRight(cmd.Username, cmd.Password, "dropindex") {
+		return prepMessage("You do not have access rights to drop index")
+	}
+	if !s.indexes[cmd.Key] {
+		return prepMessage("Error while dropping index " + cmd.Key)
+	}
+	delete(s.indexes, cmd.Key)
+	return prepStatus("indexdrop", "Index "+cmd.Key+" dropped")
+}
+
+func (s *Server) delete(cmd *command, defered bool) (reply []byte, broadcast *change) {
+
+	if !defered {
+		if !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-delete") {
+			return prepMessage("Delete: Access denied."), nil
+		}
+		if s.deferCommand(cmd) {
+			return nil, nil
+		}
+	}
+
+	previous, ok := s.items[cmd.Key]
+	if !ok {
+		return nil, nil
+	}
+
+	delete(s.items, cmd.Key)
+	for i, id := range s.order {
+		if id == cmd.Key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+
+	return nil, s.record(&change{message: withAction(previous, "DELETE")})
+}
+
+/* deferCommand schedule a command that must run at a later date, see DBDeferAction.
+ */
+func (s *Server) deferCommand(cmd *command) bool {
+
+	runtime := time.Unix(int64(cmd.Defered), 0)
+	if cmd.Defered == 0 || runtime.Before(time.Now()) {
+		return false
+	}
+
+	c := *cmd
+	s.timers = append(s.timers, time.AfterFunc(time.Until(runtime), func() {
+
+		var broadcast *change
+
+		s.mu.Lock()
+		switch c.Action {
+		case "INSERT":
+			_, broadcast = s.insert(&c, true)
+		case "UPDATE":
+			_, broadcast = s.update(&c, true)
+		case "DELETE":
+			_, broadcast = s.delete(&c, true)
+		}
+		s.mu.Unlock()
+
+		if broadcast != nil {
+			s.broadcast(broadcast)
+		}
+	}))
+	return true
+}
+
+func (s *Server) registration(c *client, cmd *command) []byte {
+
+	action := strings.ToLower(cmd.Action)
+	bucketname := strconv.Quote(cmd.Bucketname)
+
+	if !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-read") {
+		return []byte(`{"action": "` + action + `", "bucketname":` + bucketname + `, "status":false, "error":"access denied" }`)
+	}
+
+	r := registration{bucketname: cmd.Bucketname}
+	if len(cmd.Data) > 0 && string(cmd.Data) != "null" {
+		filter, ok := parseQuery(cmd.Data)
+		if !ok {
+			return []byte(`{"action": "` + action + `", "bucketname":` + bucketname + `, "status":false, "error":"Invalid filter" }`)
+		}
+		key, _ := json.Marshal(filter)
+		r.filter, r.key = filter, string(key)
+	}
+
+	if cmd.Action == "REGISTEREVENT" {
+		c.registerEvents = append(c.registerEvents, r)
+	} else {
+		// remove the last registration with the same filter, or the last one
+		// if none match and no filter is given
+		i := -1
+		for j := len(c.registerEvents) - 1; j >= 0; j-- {
+			if strings.EqualFold(c.registerEvents[j].bucketname, r.bucketname) {
+				if c.registerEvents[j].key == r.key {
+					i = j
+					break
+				}
+				if i < 0 && r.key == "" {
+					i = j
+				}
+			}
+		}
+		if i >= 0 {
+			c.registerEvents = append(c.registerEvents[:i], c.registerEvents[i+1:]...)
+		}
+	}
+
+	return []byte(`{"action": "` + action + `", "bucketname":` + bucketname + `, "status":true}`)
+}
+
+func (s *Server) watch(c *client, cmd *command) []byte {
+
+	action := strings.ToLower(cmd.Action)
+	bucketname := strconv.Quote(cmd.Bucketname)
+
+	ids := []string{}
+	if cmd.Key != "" {
+		ids = append(ids, cmd.Key)
+	} else if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, &ids); err != nil {
+			return []byte(`{"action": "` + action + `", "bucketname":` + bucketname + `, "ids":null, "status":false, "error":"data must be an array of $id" }`)
+		}
+	}
+	if len(ids) == 0 {
+		return []byte(`{"action": "` + action + `", "bucketname":` + bucketname + `, "ids":null, "status":false, "error":"no $id provided" }`)
+	}
+	list, _ := json.Marshal(ids)
+
+	if !s.hasRight(cmd.Username, cmd.Password, cmd.Bucketname+"-read") {
+		return []byte(`{"action": "` + action + `", "bucketname":` + bucketname + `, "ids":` + string(list) + `, "status":false, "error":"access denied" }`)
+	}
+
+	if c.watching == nil {
+		c.watching = map[watch]int{}
+	}
+	for _, id := range ids {
+		w := watch{bucketname: strings.ToLower(cmd.Bucketname), id: id}
+		if cmd.Action == "WATCH" {
+			c.watching[w]++
+		} else if c.watching[w] > 1 {
+			c.watching[w]--
+		} else {
+			delete(c.watching, w)
+		}
+	}
+
+	return []byte(`{"action": "` + action + `", "bucketname":` + bucketname + `, "ids":` + string(list) + `, "status":true}`)
+}
+
+func (s *Server) presence(c *client, cmd *command) []byte {
+
+	bucketname := strconv.Quote(cmd.Bucketname)
+
+	if cmd.Key != "" && cmd.Key != "on" && cmd.Key != "off" {
+		return []byte(`{"action":"presence", "bucketname":` + bucketname + `, "status":false, "error":"key must be on, off or empty" }`)
+	}
+	if cmd.Username == "" && cmd.Bucketname == "" || !s.hasRight(cmd.Username, cmd.Password, presenceRight(cmd.Bucketname)+"-read") {
+		return []byte(`{"action":"presence", "bucketname":` + bucketname + `, "status":false, "error":"access denied" }`)
+	}
+
+	name := strings.ToLower(cmd.Bucketname)
+	if c.listening == nil {
+		c.listening = map[string]bool{}
+	}
+	switch cmd.Key {
+	case "on":
+		c.listening[name] = true
+	case "off":
+		delete(c.listening, name)
+	}
+
+	users := []string{}
+	for username := range s.present().users[name] {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	list, _ := json.Marshal(users)
+
+	return []byte(`{"action":"presence", "bucketname":` + bucketname + `, "users":` + string(list) + `, "status":true}`)
+}
+
+/* presenceRight return the bucket whose read right is needed for the
+presence of a bucket, PRESENCE without bucketname like the server.
+*/
+func presenceRight(bucketname string) string {
+	if bucketname == "" {
+		return "PRESENCE"
+	}
+	return bucketname
+}
+
+/* present return the users online and registered to each bucket, the caller
+must hold s.mu.
+*/
+func (s *Server) present() roster {
+
+	p := roster{users: map[string]map[string]bool{"": {}}, bucketnames: map[string]string{}}
+
+	for c := range s.clients {
+		if c.username == "" {
+			continue
+		}
+		p.users[""][c.username] = true
+		for _, r := range c.registerEvents {
+			name := strings.ToLower(r.bucketname)
+			if p.users[name] == nil {
+				p.users[name] = map[string]bool{}
+				p.bucketnames[name] = r.bucketname
+			}
+			p.users[name][c.username] = true
+		}
+	}
+	return p
+}
+
+/* presenceEvents compare the roster with the one before a command and return
+the events to send to the clients listening, like the server a user join
+before it subscribe and unsubscribe before it leave. The caller must hold s.mu.
+*/
+func (s *Server) presenceEvents(before roster) []delivery {
+
+	after := s.present()
+	events := []delivery{}
+
+	notify := func(p roster, name, event, username string) {
+		msg := `{"action":"presence", "event":"` + event + `", "username":` + strconv.Quote(username) + `}`
+		if name != "" {
+			msg = `{"action":"presence", "event":"` + event + `", "bucketname":` + strconv.Quote(p.bucketnames[name]) + `, "username":` + strconv.Quote(username) + `}`
+		}
+		for c := range s.clients {
+			if !c.listening[name] || c.username == "" {
+				continue
+			}
+			if !s.hasRight(c.username, c.password, presenceRight(p.bucketnames[name])+"-read") {
+				continue
+			}
+			events = append(events, delivery{client: c, message: []byte(msg)})
+		}
+	}
+
+	// "" is sorted first, join is sent before subscribe and leave after unsubscribe
+	for _, name := range sortedKeys(after.users) {
+		for _, username := range sortedKeys(after.users[name]) {
+			if before.users[name][username] {
+				continue
+			}
+			if name == "" {
+				notify(after, name, "join", username)
+			} else {
+				notify(after, name, "subscribe", username)
+			}
+		}
+	}
+
+	names := sortedKeys(before.users)
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		for _, username := range sortedKeys(before.users[name]) {
+			if after.users[name][username] {
+				continue
+			}
+			if name == "" {
+				notify(before, name, "leave", username)
+			} else {
+				notify(before, name, "unsubscribe", username)
+			}
+		}
+	}
+
+	return events
+}
+
+/* sortedKeys return the keys of a map sorted.
+ */
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/* broadcast send a change to the clients registered to the bucket or watching
+the item, an UPDATE is sent to a filtered registration if the item match before
+or after the change.
+*/
+func (s *Server) broadcast(ch *change) {
+
+	s.mu.Lock()
+	clients := []*client{}
+	for c := range s.clients {
+		if s.receive(c, ch) {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.send(ch.message)
+	}
+}
+
+/* receive return true if a change must be sent to a client, the caller must
+hold s.mu.
+*/
+func (s *Server) receive(c *client, ch *change) bool {
+
+	bucketname := gjson.GetBytes(ch.message, "$bucketname").String()
+	w := watch{bucketname: strings.ToLower(bucketname), id: gjson.GetBytes(ch.message, "$id").String()}
+
+	// the rights are verified again, AddUser may have changed them
+	if !s.hasRight(c.username, c.password, bucketname+"-read") {
+		return false
+	}
+	if c.watching[w] > 0 {
+		return true
+	}
+	for _, r := range c.registerEvents {
+		if !strings.EqualFold(r.bucketname, bucketname) {
+			continue
+		}
+		if r.filter == nil || r.filter.match(ch.message) || (ch.previous != nil && r.filter.match(ch.previous)) {
+			return true
+		}
+	}
+	return false
+}
+
+/* record give the next $seq to a change and keep it for RESUME, the caller must
+hold s.mu.
+*/
+func (s *Server) record(ch *change) *change {
+	s.seq++
+	ch.seq = s.seq
+	ch.message = withField(ch.message, "$seq", ch.seq)
+	s.changes = append(s.changes, ch)
+	return ch
+}
+
+/*ForgetChanges remove the changes kept for RESUME like the logs deleted after
+the retention of the real server, a client that resume is told to do a full
+resync.
+*/
+func (s *Server) ForgetChanges() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes = nil
+}
+
+func (s *Server) resume(c *client, cmd *command) []byte {
+
+	after, err := strconv.ParseUint(cmd.Key, 10, 64)
+	if err != nil {
+		return []byte(`{"action": "resume", "status":false, "resync":false, "error":` + strconv.Quote("Invalid sequence "+cmd.Key) + ` }`)
+	}
+
+	first := s.seq + 1
+	if len(s.changes) > 0 {
+		first = s.changes[0].seq
+	}
+	if after > s.seq || after+1 < first {
+		return []byte(`{"action": "resume", "status":false, "resync":true, "error":"full resync needed" }`)
+	}
+
+	items := []string{}
+	for _, ch := range s.changes {
+		if ch.seq > after && s.receive(c, ch) {
+			items = append(items, string(ch.message))
+		}
+	}
+
+	return []byte(`{"action": "resume", "status":true, "seq":` + strconv.FormatUint(s.seq, 10) + `, "items":[` + strings.Join(items, ",") + `]}`)
+}
+
+func (c *client) send(message []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.ws.WriteMessage(websocket.TextMessage, message)
+}
+
+/* store add or replace an item, the caller must hold s.mu.
+ */
+func (s *Server) store(id string, data []byte) {
+	if _, ok := s.items[id]; !ok {
+		s.order = append(s.order, id)
+	}
+	s.items[id] = data
+}
+
+/* bucket return the items of a bucket, the caller must hold s.mu.
+ */
+func (s *Server) bucket(bucketname string) []json.RawMessage {
+	items := []json.RawMessage{}
+	for _, id := range s.order {
+		item := s.items[id]
+		if gjson.GetBytes(item, "$bucketname").String() == bucketname {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/* prepMessage same as PrepMessageForUser.
+ */
+func prepMessage(msg string) []byte {
+	return []byte(`{ "action":"message", "message":` + strconv.Quote(msg) + `}`)
+}
+
+/* prepStatus reply to a command that succeeded, see PrepStatusForUser. */
+func prepStatus(action, msg string) []byte {
+	return []byte(`{ "action":"` + action + `", "status":true, "message":` + strconv.Quote(msg) + `}`)
+}
+
+/* setRequestID add the requestid to a reply, see SetRequestID.
+ */
+func setRequestID(msg []byte, requestid string) []byte {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return msg
+	}
+	fields["requestid"], _ = json.Marshal(requestid)
+	reply, err := json.Marshal(fields)
+	if err != nil {
+		return msg
+	}
+	return reply
+}
+
+/* withAction return the item with the action added like the logtrigger does.
+ */
+func withAction(item []byte, action string) []byte {
+	return withField(item, "action", action)
+}
+
+func withField(item []byte, name string, value interface{}) []byte {
+	fields := map[string]json.RawMessage{}
+	json.Unmarshal(item, &fields)
+	fields[name], _ = json.Marshal(value)
+	message, _ := json.Marshal(fields)
+	return message
+}
+
+var uuidv4 = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-4[0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}$`)
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+/* compare the property of an item with a value like CAST(field AS fieldtype)
+would, return -2 if the item does not have the property.
+*/
+func compare(item []byte, field, fieldtype, value string) int {
+
+	property := gjson.GetBytes(item, field)
+	if !property.Exists() || property.Type == gjson.Null {
+		return -2
+	}
+
+	if strings.EqualFold(fieldtype, "TEXT") || fieldtype == "" {
+		return strings.Compare(property.String(), value)
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return -2
+	}
+	p := property.Float()
+	if property.Type == gjson.String {
+		if p, err = strconv.ParseFloat(property.String(), 64); err != nil {
+			return -2
+		}
+	}
+
+	switch {
+	case p < v:
+		return -1
+	case p > v:
+		return 1
+	}
+	return 0
+}
+
+/* query conditions of a QUERY, see buildQuery.
+ */
+type query []jsonbarn.QueryItem
+
+func parseQuery(data []byte) (query, bool) {
+
+	q := query{}
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, false
+	}
+
+	for i, item := range q {
+		if item.Property == "" {
+			return nil, false
+		}
+		switch item.Type {
+		case "BIGINT", "INT", "TEXT", "DECIMAL", "DOUBLE":
+		default:
+			return nil, false
+		}
+		switch item.Searchtype {
+		case "EQ", "GT", "GTE", "LT", "LTE":
+			if len(item.Values) != 1 {
+				return nil, false
+			}
+		case "BETWEEN":
+			if len(item.Values) != 2 {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+		switch item.Logic {
+		case "AND", "OR":
+			if i+1 == len(q) {
+				// last item can't finish with AND or OR
+				return nil, false
+			}
+		case "":
+		default:
+			return nil, false
+		}
+	}
+
+	return q, len(q) > 0
+}
+
+/* match evaluate the conditions from left to right, AND take precedence over
+OR like in SQL.
+*/
+func (q query) match(item []byte) bool {
+
+	result := false
+	term := true
+
+	for _, c := range q {
+
+		var ok bool
+		switch c.Searchtype {
+		case "EQ":
+			ok = compare(item, c.Property, c.Type, c.Values[0]) == 0
+		case "GT":
+			ok = compare(item, c.Property, c.Type, c.Values[0]) == 1
+		case "GTE":
+			r := compare(item, c.Property, c.Type, c.Values[0])
+			ok = r == 0 || r == 1
+		case "LT":
+			ok = compare(item, c.Property, c.Type, c.Values[0]) == -1
+		case "LTE":
+			r := compare(item, c.Property, c.Type, c.Values[0])
+			ok = r == 0 || r == -1
+		case "BETWEEN":
+			low := compare(item, c.Property, c.Type, c.Values[0])
+			high := compare(item, c.Property, c.Type, c.Values[1])
+			ok = (low == 0 || low == 1) && (high == 0 || high == -1)
+		}
+
+		term = term && ok
+		if c.Logic != "AND" {
+			result = result || term
+			term = true
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,72 @@
+/*
+
+This file contain the Logger used by the client, a *slog.Logger can be used
+directly. Nothing is logged unless a Logger is set in the Options, except the
+warnings about an insecure connection that are written to stderr. The
+password of the user is never logged.
+
+	client.ConnectContext(ctx, jsonbarn.Options{
+		...
+		Logger: slog.Default(),
+	})
+
+*/
+
+package jsonbarn
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+/*Logger receive the logs of the client, args are key-value pairs like with
+log/slog.
+*/
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var _ Logger = (*slog.Logger)(nil)
+
+/* nopLogger discard everything, it is used when no Logger is set.
+ */
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
+
+/* logger return the Logger of the options.
+ */
+func (opts *Options) logger() Logger {
+	if opts.Logger == nil {
+		return nopLogger{}
+	}
+	return opts.Logger
+}
+
+/* insecureOutput receive the insecure warnings when no Logger is set. */
+var insecureOutput io.Writer = os.Stderr
+
+/* warnInsecure log a warning about an insecure connection, it is never
+silent: without Logger it is written to stderr.
+*/
+func (opts *Options) warnInsecure(msg string) {
+	if opts.Logger == nil {
+		fmt.Fprintln(insecureOutput, msg, "host="+opts.Host)
+		return
+	}
+	opts.Logger.Warn(msg, "host", opts.Host)
+}
+
+/* log return the logger of the client.
+ */
+func (j *JsonBarn) log() Logger {
+	return j.opts.logger()
+}
@@ -0,0 +1,287 @@
+/*
+
+This file contain the Mirror, a local copy of a bucket kept in memory and
+updated with the INSERT, UPDATE and DELETE broadcasted by the server.
+
+*/
+
+package jsonbarn
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+/*Change made to an item of a Mirror, Previous is nil for an INSERT and Item is
+nil for a DELETE.
+*/
+type Change struct {
+	Action   string // INSERT, UPDATE or DELETE
+	ID       string // $id of the item
+	Item     json.RawMessage
+	Previous json.RawMessage
+}
+
+/*Mirror is a thread-safe copy in memory of all the items of a bucket, items are
+kept by $id.
+*/
+type Mirror struct {
+	j          *JsonBarn
+	bucketname string
+	onChange   func(change Change)
+
+	mu      sync.RWMutex
+	items   map[string]json.RawMessage
+	loading bool     // the bucket is being reloaded
+	queued  [][]byte // broadcasts received while loading
+}
+
+/*Mirror load all the items of a bucket, register to receive the changes made to
+the bucket and keep the items up to date. The bucket is reloaded after a
+reconnect. onChange can be nil, it is called for every change from the
+goroutine that read the connection so it must not block or wait for a reply
+from the server.
+*/
+func (j *JsonBarn) Mirror(bucketname string, onChange func(change Change)) (*Mirror, error) {
+
+	m := &Mirror{j: j, bucketname: bucketname, onChange: onChange, items: map[string]json.RawMessage{}}
+
+	j.mu.Lock()
+	j.mirrors = append(j.mirrors, m)
+	j.mu.Unlock()
+
+	if err := j.RegisterEvent(bucketname); err != nil {
+		j.removeMirror(m)
+		return nil, err
+	}
+
+	if err := m.sync(false); err != nil {
+		j.removeMirror(m)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+/*Close stop updating the mirror, the bucket stay registered when RegisterEvent
+was also called by the application or by another mirror of the same bucket.
+*/
+func (m *Mirror) Close() error {
+
+	if !m.j.removeMirror(m) {
+		return nil
+	}
+
+	return m.j.UnregisterEvent(m.bucketname)
+}
+
+/*Bucketname return the name of the bucket mirrored.
+ */
+func (m *Mirror) Bucketname() string {
+	return m.bucketname
+}
+
+/*Get return the item with the $id provided.
+ */
+func (m *Mirror) Get(id string) (json.RawMessage, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	item, ok := m.items[id]
+	return item, ok
+}
+
+/*Len return the number of items in the mirror.
+ */
+func (m *Mirror) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.items)
+}
+
+/*Snapshot return a copy of all the items by $id.
+ */
+func (m *Mirror) Snapshot() map[string]json.RawMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	items := make(map[string]json.RawMessage, len(m.items))
+	for id, item := range m.items {
+		items[id] = item
+	}
+	return items
+}
+
+/* sync reload all the items of the bucket, broadcasts received during the
+load are applied once the items are loaded. If notify is true a change is
+reported for every difference with the previous items.
+*/
+func (m *Mirror) sync(notify bool) error {
+
+	m.mu.Lock()
+	m.loading = true
+	m.queued = nil
+	m.mu.Unlock()
+
+	items, err := m.j.All(m.bucketname)
+
+	changes := []Change{}
+
+	m.mu.Lock()
+
+	if err == nil {
+
+		loaded := make(map[string]json.RawMessage, len(items))
+		for _, item := range items {
+			loaded[gjson.GetBytes(item, "$id").String()] = item
+		}
+
+		if notify {
+			for id, previous := range m.items {
+				if _, ok := loaded[id]; !ok {
+					changes = append(changes, Change{Action: "DELETE", ID: id, Previous: previous})
+				}
+			}
+			for id, item := range loaded {
+				previous, ok := m.items[id]
+				if !ok {
+					changes = append(changes, Change{Action: "INSERT", ID: id, Item: item})
+				} else if !bytes.Equal(previous, item) {
+					changes = append(changes, Change{Action: "UPDATE", ID: id, Item: item, Previous: previous})
+				}
+			}
+		}
+
+		m.items = loaded
+	}
+
+	// broadcasts received while loading are newer than the items loaded
+	for _, message := range m.queued {
+		if change := m.applyLocked(message); change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	m.queued = nil
+	m.loading = false
+
+	m.mu.Unlock()
+
+	if m.onChange != nil {
+		for _, change := range changes {
+			m.onChange(change)
+		}
+	}
+
+	return err
+}
+
+/* apply a broadcast received from the server.
+ */
+func (m *Mirror) apply(message []byte) {
+
+	m.mu.Lock()
+	if m.loading {
+		m.queued = append(m.queued, message)
+		m.mu.Unlock()
+		return
+	}
+	change := m.applyLocked(message)
+	m.mu.Unlock()
+
+	if change != nil && m.onChange != nil {
+		m.onChange(*change)
+	}
+}
+
+func (m *Mirror) applyLocked(message []byte) *Change {
+
+	action := gjson.GetBytes(message, "action").String()
+	id := gjson.GetBytes(message, "$id").String()
+	if id == "" {
+		return nil
+	}
+
+	previous, exists := m.items[id]
+
+	if action == "DELETE" {
+		if !exists {
+			return nil
+		}
+		delete(m.items, id)
+		return &Change{Action: action, ID: id, Previous: previous}
+	}
+
+	// the server add the action and the $seq to the item, remove them
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil
+	}
+	delete(fields, "action")
+	delete(fields, "$seq")
+	item, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+
+	m.items[id] = item
+	return &Change{Action: action, ID: id, Item: item, Previous: previous}
+}
+
+/* notifyMirrors give a broadcast to the mirrors of the bucket.
+ */
+func (j *JsonBarn) notifyMirrors(message []byte) {
+
+	action := gjson.GetBytes(message, "action").String()
+	if action != "INSERT" && action != "UPDATE" && action != "DELETE" {
+		return
+	}
+
+	bucketname := gjson.GetBytes(message, "$bucketname").String()
+
+	j.mu.Lock()
+	mirrors := []*Mirror{}
+	for _, m := range j.mirrors {
+		if strings.EqualFold(m.bucketname, bucketname) {
+			mirrors = append(mirrors, m)
+		}
+	}
+	j.mu.Unlock()
+
+	for _, m := range mirrors {
+		m.apply(message)
+	}
+}
+
+/* removeMirror return false if the mirror was already removed.
+ */
+func (j *JsonBarn) removeMirror(m *Mirror) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range j.mirrors {
+		if j.mirrors[i] == m {
+			j.mirrors = append(j.mirrors[:i], j.mirrors[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/* syncMirrors reload all the mirrors after a reconnect.
+ */
+func (j *JsonBarn) syncMirrors() error {
+
+	j.mu.Lock()
+	mirrors := append([]*Mirror(nil), j.mirrors...)
+	j.mu.Unlock()
+
+	var failed error
+	for _, m := range mirrors {
+		if err := m.sync(true); err != nil {
+			j.log().Warn("jsonbarn: unable to reload mirror", "bucket", m.bucketname, "error", err)
+			failed = err
+		}
+	}
+	return failed
+}
@@ -0,0 +1,152 @@
+package jsonbarn_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/tidwall/gjson"
+)
+
+func TestMirror(t *testing.T) {
+	srv := newServer(t)
+	first, _ := srv.Put("INCIDENTS", map[string]int{"level": 1})
+	second, _ := srv.Put("INCIDENTS", map[string]int{"level": 2})
+
+	writer := connect(t, srv.Options("ann", "secret"))
+
+	resubscribed := make(chan error, 10)
+	opts := srv.Options("ann", "secret")
+	opts.OnResubscribe = func(buckets []string, err error) {
+		resubscribed <- err
+	}
+	c := connect(t, opts)
+
+	var mu sync.Mutex
+	changes := []jsonbarn.Change{}
+	changed := func(n int) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(changes) == n
+		}
+	}
+
+	m, err := c.Mirror("INCIDENTS", func(change jsonbarn.Change) {
+		mu.Lock()
+		changes = append(changes, change)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 {
+		t.Fatal("len", m.Len())
+	}
+
+	// the broadcasts update the items
+	insert(t, writer, "INCIDENTS", 3)
+	waitFor(t, "insert", changed(1))
+	if m.Len() != 3 || changes[0].Action != "INSERT" || gjson.GetBytes(changes[0].Item, "level").Int() != 3 {
+		t.Fatal(m.Len(), changes)
+	}
+	if item, _ := m.Get(changes[0].ID); gjson.GetBytes(item, "action").Exists() || gjson.GetBytes(item, "$seq").Exists() {
+		t.Fatal(string(item))
+	}
+
+	// the changes made while disconnected are reported once reloaded
+	srv.Disconnect()
+	writer = connect(t, srv.Options("ann", "secret"))
+	if err := writer.Delete("INCIDENTS", first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Update(map[string]interface{}{"$id": second, "$bucketname": "INCIDENTS", "level": 20}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-resubscribed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("not resubscribed")
+	}
+	waitFor(t, "reload", changed(3))
+
+	if _, ok := m.Get(first); ok || m.Len() != 2 {
+		t.Fatal("deleted item still mirrored", m.Len())
+	}
+	if item, _ := m.Get(second); gjson.GetBytes(item, "level").Int() != 20 {
+		t.Fatal(string(item))
+	}
+
+	// closing the mirror keep the bucket registered by the application
+	if err := c.RegisterEvent("INCIDENTS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for len(c.Ch) > 0 {
+		<-c.Ch
+	}
+	insert(t, writer, "INCIDENTS", 4)
+	receive(t, c, "INSERT")
+	if m.Len() != 2 {
+		t.Fatal("closed mirror updated", m.Len())
+	}
+}
+
+func TestMirrorShared(t *testing.T) {
+	srv := newServer(t)
+	srv.Put("INCIDENTS", map[string]int{"level": 1})
+
+	writer := connect(t, srv.Options("ann", "secret"))
+	c := connect(t, srv.Options("ann", "secret"))
+
+	first, err := c.Mirror("INCIDENTS", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.Mirror("INCIDENTS", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Len() != 1 || second.Len() != 1 {
+		t.Fatal(first.Len(), second.Len())
+	}
+
+	// both mirrors receive the change
+	insert(t, writer, "INCIDENTS", 2)
+	waitFor(t, "insert", func() bool { return first.Len() == 2 && second.Len() == 2 })
+
+	// closing one keep the bucket registered for the other
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal("closed twice", err)
+	}
+	insert(t, writer, "INCIDENTS", 3)
+	waitFor(t, "insert", func() bool { return second.Len() == 3 })
+	if first.Len() != 2 {
+		t.Fatal("closed mirror updated", first.Len())
+	}
+
+	// once both are closed the bucket is no longer registered
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for len(c.Ch) > 0 {
+		<-c.Ch
+	}
+	insert(t, writer, "INCIDENTS", 4)
+	time.Sleep(100 * time.Millisecond)
+	for len(c.Ch) > 0 {
+		if m := <-c.Ch; gjson.GetBytes(m, "action").String() == "INSERT" {
+			t.Fatal("still registered", string(m))
+		}
+	}
+}
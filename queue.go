@@ -0,0 +1,345 @@
+/*
+
+This file contain the offline queue of the client, INSERT, UPDATE and DELETE
+made while the client is not logged in are saved in a local file and sent in
+the same order once the client is logged in again.
+
+The file is a journal, it contain one command per line (JSON) and a popped
+line is appended once the server replied to the oldest write. The file is
+rewritten only when the writes replied take more room than the writes waiting.
+A write can be sent twice if the connection is lost before the reply is
+received, an INSERT is given its $id when queued and the server does not save
+an INSERT of a $id twice.
+
+*/
+
+package jsonbarn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+/*ErrQueueFull is returned when a write can't be added to the offline queue.
+ */
+var ErrQueueFull = errors.New("QueueFull")
+
+/* poppedLine is appended to the file when the oldest write is removed. */
+var poppedLine = []byte("{\"$popped\":true}\n")
+
+/* queuedWrite is a write waiting in the offline queue.
+ */
+type queuedWrite struct {
+	cmd    *Command
+	size   int             // size of the line in the file
+	result func(err error) // nil for writes loaded from the file
+}
+
+/* writeQueue is the offline queue saved in a file.
+ */
+type writeQueue struct {
+	path     string
+	maxItems int
+	maxBytes int
+
+	mu     sync.Mutex
+	items  []*queuedWrite
+	bytes  int           // size of the writes waiting
+	popped int           // size of the writes replied and of the popped lines in the file
+	signal chan struct{} // a write was added
+}
+
+/* openQueue load the writes that are still in the file.
+ */
+func openQueue(path string, maxItems, maxBytes int, log Logger) (*writeQueue, error) {
+
+	if maxItems <= 0 {
+		maxItems = 10000
+	}
+	if maxBytes <= 0 {
+		maxBytes = 16 * 1024 * 1024
+	}
+
+	q := &writeQueue{path: path, maxItems: maxItems, maxBytes: maxBytes, signal: make(chan struct{}, 1)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxBytes)
+
+	for scanner.Scan() {
+		if bytes.Equal(scanner.Bytes(), poppedLine[:len(poppedLine)-1]) {
+			if len(q.items) > 0 {
+				q.popped += q.items[0].size
+				q.bytes -= q.items[0].size
+				q.items = q.items[1:]
+			}
+			q.popped += len(poppedLine)
+			continue
+		}
+		cmd := &Command{}
+		if err := json.Unmarshal(scanner.Bytes(), cmd); err != nil {
+			// an incomplete line is left if the program stopped while writing
+			log.Warn("jsonbarn: discarding invalid line in queue", "path", path, "error", err)
+			continue
+		}
+		q.items = append(q.items, &queuedWrite{cmd: cmd, size: len(scanner.Bytes()) + 1})
+		q.bytes += len(scanner.Bytes()) + 1
+	}
+
+	return q, scanner.Err()
+}
+
+/* push add a write at the end of the queue and in the file.
+ */
+func (q *writeQueue) push(cmd *Command, result func(err error)) error {
+
+	c := *cmd
+	c.RequestID = ""
+
+	// the $id of an INSERT is kept when it is sent again
+	if c.Action == "INSERT" && c.Key == "" {
+		if c.Key = gjson.GetBytes(c.Data, "$id").String(); c.Key == "" {
+			c.Key = newID()
+		}
+	}
+
+	line, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) >= q.maxItems || q.bytes+len(line) > q.maxBytes {
+		return ErrQueueFull
+	}
+
+	f, err := os.OpenFile(q.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(line)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	q.items = append(q.items, &queuedWrite{cmd: &c, size: len(line), result: result})
+	q.bytes += len(line)
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+/* front return the oldest write or nil if the queue is empty.
+ */
+func (q *writeQueue) front() *queuedWrite {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.items[0]
+}
+
+/* pop remove the oldest write, a popped line is appended to the file.
+ */
+func (q *writeQueue) pop() error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil
+	}
+	q.popped += q.items[0].size
+	q.bytes -= q.items[0].size
+	q.items = q.items[1:]
+
+	if len(q.items) == 0 {
+		q.popped = 0
+		return os.Truncate(q.path, 0)
+	}
+
+	if q.popped > q.bytes {
+		return q.compact()
+	}
+
+	f, err := os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(poppedLine)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		q.popped += len(poppedLine)
+	}
+	return err
+}
+
+/* compact replace the file by the writes waiting so it is never left half
+written, the caller must hold q.mu.
+*/
+func (q *writeQueue) compact() error {
+
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, item := range q.items {
+		line, err := json.Marshal(item.cmd)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+	q.popped = 0
+	return nil
+}
+
+/* newID return a random UUID v4 like the server create.
+ */
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (q *writeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+/*QueueLen return the number of writes waiting in the offline queue.
+ */
+func (j *JsonBarn) QueueLen() int {
+	if j.queue == nil {
+		return 0
+	}
+	return j.queue.len()
+}
+
+/*Enqueue add a write to the offline queue, it will be sent after the writes
+already in the queue once the client is logged in. result is called with the
+reply of the server, if nil Options.OnWriteResult is called.
+*/
+func (j *JsonBarn) Enqueue(cmd *Command, result func(err error)) error {
+	if j.queue == nil {
+		return errors.New("QueueNotEnabled")
+	}
+	return j.queue.push(cmd, result)
+}
+
+/* drainQueue send the writes of the offline queue until the session end.
+ */
+func (j *JsonBarn) drainQueue(ctx context.Context) {
+
+	for {
+		for item := j.queue.front(); item != nil; item = j.queue.front() {
+
+			cmd := *item.cmd
+			_, err := j.request(&cmd)
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			var serr *ServerError
+			var rerr *RateLimitError
+			if err == ErrTimeout {
+				// the server may be busy, try again the same write
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(j.opts.MinBackoff):
+				}
+				continue
+			} else if errors.As(err, &rerr) {
+				// too many writes, try again when the server allow it
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(rerr.RetryAfter):
+				}
+				continue
+			} else if err != nil && !errors.As(err, &serr) {
+				// connection lost, the write will be sent on the next login
+				return
+			}
+
+			if perr := j.queue.pop(); perr != nil {
+				j.log().Error("jsonbarn: unable to save queue", "path", j.queue.path, "error", perr)
+			}
+
+			if item.result != nil {
+				item.result(err)
+			} else if j.opts.OnWriteResult != nil {
+				j.opts.OnWriteResult(&cmd, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.queue.signal:
+		}
+	}
+}
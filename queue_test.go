@@ -0,0 +1,137 @@
+package jsonbarn_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/tidwall/gjson"
+)
+
+func TestQueueDrain(t *testing.T) {
+	srv := newServer(t)
+
+	var mu sync.Mutex
+	results := []error{}
+	states := make(chan jsonbarn.State, 10)
+
+	opts := srv.Options("ann", "secret")
+	opts.QueuePath = filepath.Join(t.TempDir(), "queue")
+	opts.MinBackoff = 200 * time.Millisecond
+	opts.MaxBackoff = 200 * time.Millisecond
+	opts.OnState = func(state jsonbarn.State, err error) {
+		select {
+		case states <- state:
+		default:
+		}
+	}
+	opts.OnWriteResult = func(cmd *jsonbarn.Command, err error) {
+		mu.Lock()
+		results = append(results, err)
+		mu.Unlock()
+	}
+	c := connect(t, opts)
+
+	// the writes made while disconnected are queued
+	srv.Disconnect()
+	for state := range states {
+		if state == jsonbarn.StateDisconnected {
+			break
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		insert(t, c, "INCIDENTS", i)
+	}
+	if c.QueueLen() != 3 {
+		t.Fatal("queued", c.QueueLen())
+	}
+
+	// and sent in order once logged in again
+	waitFor(t, "drain", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(results) == 3
+	})
+	for _, err := range results {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.QueueLen() != 0 {
+		t.Fatal("queued", c.QueueLen())
+	}
+
+	items := srv.Items("INCIDENTS")
+	if len(items) != 3 {
+		t.Fatal("items", len(items))
+	}
+	for i, item := range items {
+		if gjson.GetBytes(item, "level").Int() != int64(i+1) {
+			t.Fatal(string(item))
+		}
+	}
+
+	// a new client load the file, nothing is left to send
+	other := jsonbarn.NewClient()
+	if err := other.ConnectContext(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if other.QueueLen() != 0 {
+		t.Fatal("queued", other.QueueLen())
+	}
+}
+
+func TestQueueReplyLost(t *testing.T) {
+	srv := newServer(t)
+
+	results := make(chan error, 10)
+	opts := srv.Options("ann", "secret")
+	opts.QueuePath = filepath.Join(t.TempDir(), "queue")
+	opts.OnWriteResult = func(cmd *jsonbarn.Command, err error) {
+		results <- err
+	}
+
+	// the client will not wait long for the reply that is lost
+	c := jsonbarn.NewClient()
+	c.Timeout = 100 * time.Millisecond
+	if err := c.ConnectContext(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	receive(t, c, "login")
+
+	if err := c.RegisterEvent("INCIDENTS"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the INSERT is saved but the reply is lost, it is sent again
+	srv.DropReplies("INSERT", 1)
+	if err := c.Enqueue(&jsonbarn.Command{Action: "INSERT", Bucketname: "INCIDENTS", Data: []byte(`{"level":1}`)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("no result")
+	}
+	if items := srv.Items("INCIDENTS"); len(items) != 1 {
+		t.Fatal("items", len(items))
+	}
+
+	// the second INSERT changed nothing
+	receive(t, c, "INSERT")
+	time.Sleep(50 * time.Millisecond)
+	for len(c.Ch) > 0 {
+		if m := <-c.Ch; gjson.GetBytes(m, "action").String() == "INSERT" {
+			t.Fatal("saved twice", string(m))
+		}
+	}
+}
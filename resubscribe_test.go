@@ -0,0 +1,81 @@
+package jsonbarn_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/marcgauthier/jsonbarn"
+	"github.com/tidwall/gjson"
+)
+
+func TestReconnectResume(t *testing.T) {
+	srv := newServer(t)
+	writer := connect(t, srv.Options("ann", "secret"))
+
+	// the writer make its changes before the client reconnect
+	resubscribed := make(chan error, 10)
+	opts := srv.Options("ann", "secret")
+	opts.MinBackoff = 200 * time.Millisecond
+	opts.MaxBackoff = 200 * time.Millisecond
+	opts.OnResubscribe = func(buckets []string, err error) {
+		resubscribed <- err
+	}
+	c := connect(t, opts)
+
+	if err := c.RegisterEvent("INCIDENTS"); err != nil {
+		t.Fatal(err)
+	}
+	insert(t, writer, "INCIDENTS", 1)
+	receive(t, c, "INSERT")
+	seq := c.Seq()
+
+	// the changes made while disconnected are replayed once registered again
+	srv.Disconnect()
+	writer = connect(t, srv.Options("ann", "secret"))
+	insert(t, writer, "INCIDENTS", 2)
+	insert(t, writer, "INCIDENTS", 3)
+
+	select {
+	case err := <-resubscribed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("not resubscribed")
+	}
+
+	for _, level := range []string{"2", "3"} {
+		if m := receive(t, c, "INSERT"); gjson.GetBytes(m, "level").String() != level {
+			t.Fatal(string(m))
+		}
+	}
+	if c.Seq() != seq+2 {
+		t.Fatal("seq", c.Seq())
+	}
+
+	// registered once, a change is received once
+	insert(t, writer, "INCIDENTS", 4)
+	receive(t, c, "INSERT")
+	time.Sleep(50 * time.Millisecond)
+	for len(c.Ch) > 0 {
+		if m := <-c.Ch; gjson.GetBytes(m, "action").String() == "INSERT" {
+			t.Fatal("received twice", string(m))
+		}
+	}
+
+	// the server forgot the changes, the client must reload
+	srv.Disconnect()
+	writer = connect(t, srv.Options("ann", "secret"))
+	insert(t, writer, "INCIDENTS", 5)
+	srv.ForgetChanges()
+	select {
+	case err := <-resubscribed:
+		if !errors.Is(err, jsonbarn.ErrResyncNeeded) {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("not resubscribed")
+	}
+	receive(t, c, "resync")
+}
@@ -0,0 +1,276 @@
+/*
+______________________________________________________________________________
+
+ Ecureuil - Web framework for real-time javascript app.
+_____________________________________________________________________________
+
+MIT License
+
+Copyright (c) 2014-2016 Marc Gauthier
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+______________________________________________________________________________
+
+
+This file contain the registry of the actions a websocket client can send.
+Every command received is given to the handler registered for its action,
+through the middlewares that log, rate limit and authorize the commands.
+An application embedding this package can register its own actions:
+
+	models.RegisterAction("PING", func(c *models.Client, packet *models.MsgClientCmd) ([]byte, error) {
+		return []byte("{\"action\":\"pong\"}"), nil
+	}, "", models.RateClassRead)
+
+______________________________________________________________________________
+
+*/
+
+package models
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antigloss/go/logger"
+)
+
+/*ActionHandler execute a command received from a websocket client, the reply is
+sent to the client and the error is logged. When the reply is nil and the
+client provided a requestid it receive the error as a message, or an ack.
+*/
+type ActionHandler func(c *Client, packet *MsgClientCmd) ([]byte, error)
+
+/*ActionMiddleware wrap the handler of an action, it can refuse the command by
+returning a reply without calling next.
+*/
+type ActionMiddleware func(action *TAction, next ActionHandler) ActionHandler
+
+/*TAction an action registered with RegisterAction. RequiredRight is verified
+before the handler is called, {bucketname} is replaced by the bucketname of the
+command i.e. "{bucketname}-read". The built-in actions verify the rights
+themselves and have no RequiredRight.
+*/
+type TAction struct {
+	Name          string
+	Handler       ActionHandler
+	RequiredRight string
+	RateClass     string // RateClassRead, RateClassWrite, RateClassAdmin or "" when not limited
+}
+
+/* actions registered and the middlewares applied to them, the first middleware
+is the first called.
+*/
+var actions = struct {
+	sync.RWMutex
+	registered  map[string]*TAction
+	middlewares []ActionMiddleware
+}{registered: make(map[string]*TAction)}
+
+/*RegisterAction add or replace the handler of an action, the name is the action
+sent by the client in uppercase. rateClass is the class of action the command
+is counted in by the rate limits, "" for an action that is not limited.
+*/
+func RegisterAction(name string, handler ActionHandler, requiredRight, rateClass string) {
+	actions.Lock()
+	defer actions.Unlock()
+	actions.registered[name] = &TAction{Name: name, Handler: handler, RequiredRight: requiredRight, RateClass: rateClass}
+}
+
+/*UseActionMiddleware add a middleware called for every action after the ones
+already added.
+*/
+func UseActionMiddleware(middleware ActionMiddleware) {
+	actions.Lock()
+	defer actions.Unlock()
+	actions.middlewares = append(actions.middlewares, middleware)
+}
+
+/* dispatch execute a command with the handler registered for its action, an
+unknown action receive an error message.
+*/
+func (c *Client) dispatch(packet *MsgClientCmd) ([]byte, error) {
+
+	actions.RLock()
+	action, ok := actions.registered[packet.Action]
+	middlewares := actions.middlewares
+	actions.RUnlock()
+
+	if !ok {
+		logger.Warn("User " + c.username + " sent unknown action " + packet.Action)
+		return PrepMessageForUser("Unknown action " + packet.Action), nil
+	}
+
+	handler := action.Handler
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](action, handler)
+	}
+
+	return handler(c, packet)
+}
+
+/* logAction trace every command and how long it took. */
+func logAction(action *TAction, next ActionHandler) ActionHandler {
+	return func(c *Client, packet *MsgClientCmd) ([]byte, error) {
+		start := time.Now()
+		reply, err := next(c, packet)
+		logger.Trace("Action " + action.Name + " from " + c.username + " took " + time.Since(start).String())
+		return reply, err
+	}
+}
+
+/* limitAction refuse the command when the client sent too many commands of
+its class, see TAction.RateClass.
+*/
+func limitAction(action *TAction, next ActionHandler) ActionHandler {
+	return func(c *Client, packet *MsgClientCmd) ([]byte, error) {
+		if retry := c.rateLimited(action.RateClass); retry > 0 {
+			logger.Warn("User " + c.username + " sent too many " + action.RateClass + " commands, " + action.Name + " refused")
+			return rateLimitedMessage(action.Name, action.RateClass, retry), nil
+		}
+		return next(c, packet)
+	}
+}
+
+/* authorizeAction replace any credential provided with the credential of the
+connection and verify the RequiredRight of the action. LOGIN carry the
+credential to verify, they are kept.
+*/
+func authorizeAction(action *TAction, next ActionHandler) ActionHandler {
+	return func(c *Client, packet *MsgClientCmd) ([]byte, error) {
+
+		if action.Name != "LOGIN" {
+			packet.Username = c.username
+			packet.Password = c.password
+		}
+
+		if action.RequiredRight != "" {
+			right := strings.Replace(action.RequiredRight, "{bucketname}", packet.Bucketname, -1)
+			access, err := UserHasRight([]byte(packet.Username), []byte(packet.Password), right)
+			if err != nil || !access {
+				logger.Warn("Access denied: User " + packet.Username + " " + action.Name + " require " + right)
+				return PrepMessageForUser("Access denied, " + action.Name + " require the " + right + " right"), nil
+			}
+		}
+
+		return next(c, packet)
+	}
+}
+
+/* packetAction adapt a function that only need the command to an ActionHandler. */
+func packetAction(f func(packet *MsgClientCmd) ([]byte, error)) ActionHandler {
+	return func(c *Client, packet *MsgClientCmd) ([]byte, error) {
+		return f(packet)
+	}
+}
+
+func init() {
+
+	UseActionMiddleware(logAction)
+	UseActionMiddleware(limitAction)
+	UseActionMiddleware(authorizeAction)
+
+	RegisterAction("LOGIN", login, "", "")
+	RegisterAction("LOGOUT", logout, "", "")
+
+	/*
+	   Request information from a bucket should contain: bucketname and
+	   the key, searchfield, maxkey or data of the type of read.
+	*/
+	for _, name := range []string{"QUERY", "READALL", "READONE", "READFIND", "READRANGE"} {
+		RegisterAction(name, packetAction(DBRead), "", RateClassRead)
+	}
+
+	/*
+	   Request to insert, update or delete an item should contain bucketname,
+	   the $id in key for a delete. If the change is valid a broadcast will be sent.
+	*/
+	RegisterAction("INSERT", packetAction(func(packet *MsgClientCmd) ([]byte, error) {
+		return DBInsert(packet, false)
+	}), "", RateClassWrite)
+	RegisterAction("UPDATE", packetAction(func(packet *MsgClientCmd) ([]byte, error) {
+		return DBUpdate(packet, false)
+	}), "", RateClassWrite)
+	RegisterAction("DELETE", packetAction(func(packet *MsgClientCmd) ([]byte, error) {
+		return DBDelete(packet, false)
+	}), "", RateClassWrite)
+
+	RegisterAction("SETUSERSETTING", packetAction(DBUserSettings), "", RateClassWrite)
+	RegisterAction("LOGS", packetAction(DBGetLogs), "", RateClassAdmin)
+	RegisterAction("REGISTEREVENT", registerEvent, "", RateClassRead)
+	RegisterAction("UNREGISTEREVENT", unregisterEvent, "", RateClassRead)
+	RegisterAction("WATCH", watchEvent, "", RateClassRead)
+	RegisterAction("UNWATCH", watchEvent, "", RateClassRead)
+	RegisterAction("RESUME", resumeEvents, "", RateClassRead)
+	RegisterAction("PRESENCE", presenceEvent, "", RateClassRead)
+	RegisterAction("GETTIME", packetAction(func(packet *MsgClientCmd) ([]byte, error) {
+		return GetTime(), nil
+	}), "", RateClassRead)
+	RegisterAction("STATS", statsAction, "stats-read", RateClassAdmin)
+	RegisterAction("GETCONFIG", packetAction(GetConfiguration), "", RateClassAdmin)
+	RegisterAction("PUTCONFIG", packetAction(PutConfiguration), "", RateClassAdmin)
+	RegisterAction("GETUSERS", packetAction(GetUsers), "", RateClassAdmin)
+	RegisterAction("INDEXCREATE", packetAction(DBCreateIndex), "", RateClassAdmin)
+	RegisterAction("INDEXDROP", packetAction(DBDropIndex), "", RateClassAdmin)
+	RegisterAction("INDEXLIST", packetAction(DBListIndex), "", RateClassAdmin)
+	RegisterAction("EMAILALERT", packetAction(ReceiveEmailAlertChangeReq), "", RateClassWrite)
+}
+
+/* login verify the credential and keep them for the duration of the websocket
+connection, a bad request does not lose the credential already loaded.
+*/
+func login(c *Client, packet *MsgClientCmd) ([]byte, error) {
+
+	if packet.Version != 0 && packet.Version != ProtocolVersion {
+		logger.Warn("User " + packet.Username + " use protocol version " + strconv.Itoa(packet.Version))
+		return []byte("{ \"action\":\"login\", \"result\":\"failed\", \"username\":\"" + EscDoubleQuote(packet.Username) + "\", \"version\":" + strconv.Itoa(ProtocolVersion) +
+			", \"error\":\"Unsupported protocol version " + strconv.Itoa(packet.Version) + ", server use version " + strconv.Itoa(ProtocolVersion) + "\"}"), nil
+	}
+
+	c.LoginAttempts = append(c.LoginAttempts, uint64(time.Now().UTC().Unix()))
+
+	count := c.ClearLoginAttempt()
+	if count > Configuration.LoginPerMin {
+		return PrepMessageForUser("You have exceeded the maximum number of login attempt, try again in 1 min!"), nil
+	}
+
+	user, err := DBLogin(packet)
+
+	if err == nil {
+		c.password = packet.Password
+		c.username = packet.Username
+		c.user.Store(c.username)
+		c.rememberRegistrations()
+		c.identify()
+		logger.Info("User " + c.username + " as logged in on this websocket!")
+	}
+
+	return user, err
+}
+
+/* logout discard the credential of the connection, the connection is kept. */
+func logout(c *Client, packet *MsgClientCmd) ([]byte, error) {
+	c.password = ""
+	c.username = ""
+	c.user.Store(c.username)
+	c.identify()
+	return []byte("{ \"action\":\"logout\"}"), nil
+}
@@ -49,11 +49,23 @@ package models
 
 import "sync"
 
+/*TBroadcast message to send to the clients registered to a bucket, an empty
+Bucketname send the message to every client. Previous contain the object
+before an UPDATE when it is known, it is use to filter the broadcasts.
+*/
+type TBroadcast struct {
+	Bucketname string
+	ID         string // $id of the object, use to find the clients watching it
+	Message    []byte
+	Previous   []byte
+	Resync     bool // the change could not be read, the clients are told to reload their data
+}
+
 /* declare a type to hold all the messages with sync capabillity. */
 
 type tMessageQueue struct {
 	sync.RWMutex
-	queue [][]byte
+	queue []*TBroadcast
 }
 
 /* declare a container to hold all the messages with sync capabillity. */
@@ -64,10 +76,10 @@ var messages tMessageQueue
 
 /*BroadcastGet extract queue message
  */
-func BroadcastGet() []byte {
+func BroadcastGet() *TBroadcast {
 
 	// declare return object.
-	var item []byte
+	var item *TBroadcast
 
 	/* lock the message object so we can safely delete the queue */
 	messages.Lock()
@@ -84,19 +96,39 @@ func BroadcastGet() []byte {
 	return item
 }
 
-/*BroadcastPut add a message to the broadcaster, in the form bucket:message
+/*BroadcastPut add a message to the broadcaster for the clients registered to bucket
  */
 func BroadcastPut(bucket, message string) error {
+	return BroadcastPutChange(bucket, "", []byte(message), nil)
+}
+
+/*BroadcastPutChange add a change to the broadcaster for the clients registered to
+bucket or watching the object id, previous is the object before an UPDATE or nil.
+*/
+func BroadcastPutChange(bucket, id string, message, previous []byte) error {
 
 	// lock queue before we can insert data.
 	messages.Lock()
 	defer messages.Unlock()
 
 	// insert data
-	messages.queue = append(messages.queue, []byte(bucket+":"+message))
+	messages.queue = append(messages.queue, &TBroadcast{Bucketname: bucket, ID: id, Message: message, Previous: previous})
 
 	// return no error
 	return nil
 
 	// defered unlock is executed here.
 }
+
+/*BroadcastResync tell the clients registered to bucket or watching the object
+id to reload their data, i.e. when a change could not be read to broadcast it.
+*/
+func BroadcastResync(bucket, id string) error {
+
+	messages.Lock()
+	defer messages.Unlock()
+
+	messages.queue = append(messages.queue, &TBroadcast{Bucketname: bucket, ID: id, Resync: true})
+
+	return nil
+}
@@ -122,8 +122,34 @@ type TConfig struct {
 	MaxOpenSQLConns int `json:"maxopensqlconns"`
 
 	MaxLifetimeSQLConns int `json:"maxlifetimesqlconns"` // in seconds default to 0 unlimited
+
+	ClientQueueSize int `json:"clientqueuesize"` // number of messages waiting to be sent to a websocket client, default 8192
+
+	SlowClientPolicy string `json:"slowclientpolicy"` // what to do when the queue of a client is full, "drop" (default) or "disconnect"
+
+	PingInterval int `json:"pinginterval"` // in seconds between the pings sent to a websocket client, default 30
+
+	PongTimeout int `json:"pongtimeout"` // in seconds without a pong or a message before a websocket client is closed, default 60
+
+	WriteTimeout int `json:"writetimeout"` // in seconds to send a message to a websocket client before it is closed, default 10
+
+	MaxMessageSize int64 `json:"maxmessagesize"` // in bytes of the largest message accepted from a websocket client, default 1048576
+
+	ConnectionRateLimits TRateLimits `json:"connectionratelimits"` // commands per second allowed for each websocket connection by class of action
+
+	UserRateLimits TRateLimits `json:"userratelimits"` // commands per second allowed for all the connections of a user by class of action
 }
 
+/*SlowClientDrop drop the broadcasts a client can't receive in time and tell the
+client to reload its data with a "resync" message.
+*/
+const SlowClientDrop = "drop"
+
+/*SlowClientDisconnect close the websocket of a client that can't receive the
+broadcasts in time.
+*/
+const SlowClientDisconnect = "disconnect"
+
 /*ConfigBUCKET name of the command send by front-end to access the configuration.
   This value is use by database.go
 */
@@ -206,9 +232,10 @@ func PutConfiguration(packet *MsgClientCmd) ([]byte, error) {
 
 	// Make sure value in the config object are valid.
 	//************************************************
+	setMissingConfig(&item, packet.Data)
 	err = ValidateConfig(&item)
 	if err != nil {
-		logger.Warn("Can't validate configuration provided by User: " + packet.Username + " error: " + errcode.Error())
+		logger.Warn("Can't validate configuration provided by User: " + packet.Username + " error: " + err.Error())
 		return nil, err
 	}
 
@@ -240,6 +267,14 @@ func PutConfiguration(packet *MsgClientCmd) ([]byte, error) {
 	Configuration.MaxIdleSQLConns = item.MaxIdleSQLConns
 	Configuration.MaxOpenSQLConns = item.MaxOpenSQLConns
 	Configuration.MaxLifetimeSQLConns = item.MaxLifetimeSQLConns
+	Configuration.ClientQueueSize = item.ClientQueueSize
+	Configuration.SlowClientPolicy = item.SlowClientPolicy
+	Configuration.PingInterval = item.PingInterval
+	Configuration.PongTimeout = item.PongTimeout
+	Configuration.WriteTimeout = item.WriteTimeout
+	Configuration.MaxMessageSize = item.MaxMessageSize
+	Configuration.ConnectionRateLimits = item.ConnectionRateLimits
+	Configuration.UserRateLimits = item.UserRateLimits
 
 	// ReSerialize packet to save and do not broadast.
 	// user can set any key they want but "currentconfig" need to be use
@@ -254,7 +289,7 @@ func PutConfiguration(packet *MsgClientCmd) ([]byte, error) {
 		return PrepMessageForUser("Error while saving configuration:" + err.Error()), nil
 	}
 
-	return PrepMessageForUser("Configuration saved"), nil
+	return PrepStatusForUser("putconfig", "Configuration saved"), nil
 
 }
 
@@ -290,6 +325,15 @@ func ConfigurationINIT() {
 			logger.Error(err.Error())
 			panic("bad configuraton!")
 		}
+
+		// a configuration saved by an older version does not have the new settings
+		setMissingConfig(&Configuration, []byte(data))
+
+		err = ValidateConfig(&Configuration)
+		if err != nil {
+			logger.Error(err.Error())
+			panic("bad configuraton!")
+		}
 		logger.Trace("Configuration reed from SQL!")
 		return // good to go!
 	}
@@ -324,6 +368,34 @@ func ValidateConfig(config *TConfig) error {
 		return errors.New("SMTP Port is not valid (0..65535)")
 	}
 
+	if config.ClientQueueSize < 0 {
+		return errors.New("Client queue size can't be negative")
+	}
+
+	if config.SlowClientPolicy != "" && config.SlowClientPolicy != SlowClientDrop && config.SlowClientPolicy != SlowClientDisconnect {
+		return errors.New("Slow client policy must be " + SlowClientDrop + " or " + SlowClientDisconnect)
+	}
+
+	if config.PingInterval < 0 || config.PongTimeout < 0 || config.WriteTimeout < 0 {
+		return errors.New("Ping interval, pong timeout and write timeout can't be negative")
+	}
+
+	if config.PingInterval > 0 && config.PongTimeout > 0 && config.PongTimeout <= config.PingInterval {
+		return errors.New("Pong timeout must be longer than the ping interval")
+	}
+
+	if config.MaxMessageSize < 0 {
+		return errors.New("Max message size can't be negative")
+	}
+
+	if err := config.ConnectionRateLimits.validate(); err != nil {
+		return err
+	}
+
+	if err := config.UserRateLimits.validate(); err != nil {
+		return err
+	}
+
 	// configuration is valid
 	return nil
 }
@@ -394,5 +466,39 @@ func setDefaultConfig() {
 	Configuration.MaxIdleSQLConns = 0
 	Configuration.MaxLifetimeSQLConns = 0
 	Configuration.LoginPerMin = 3
+	Configuration.ClientQueueSize = websocketBufferSize
+	Configuration.SlowClientPolicy = SlowClientDrop
+	setMissingConfig(&Configuration, nil)
 
 }
+
+/* setMissingConfig set the default value of the settings that are not in a
+configuration, data is the JSON the configuration was read from. A rate limit
+of 0 is unlimited, the default limits are only set when they are not in data.
+*/
+func setMissingConfig(config *TConfig, data []byte) {
+
+	stored, err := gabs.ParseJSON(data)
+	if err != nil || !stored.Exists("connectionratelimits") {
+		config.ConnectionRateLimits = defaultConnectionRateLimits
+	}
+	if err != nil || !stored.Exists("userratelimits") {
+		config.UserRateLimits = defaultUserRateLimits
+	}
+
+	if config.PingInterval == 0 {
+		config.PingInterval = defaultPingInterval
+	}
+	if config.PongTimeout == 0 {
+		config.PongTimeout = defaultPongTimeout
+		if config.PongTimeout <= config.PingInterval {
+			config.PongTimeout = 2 * config.PingInterval
+		}
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = defaultWriteTimeout
+	}
+	if config.MaxMessageSize == 0 {
+		config.MaxMessageSize = defaultMaxMessageSize
+	}
+}
@@ -82,10 +82,13 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
-/*TNotification contain the structure to hold item received from postgresql
- */
+/*TNotification contain the structure to hold item received from postgresql, the
+trigger only send the action, $bucketname, $id and $seq. The object is read
+from the logs row $seq.
+*/
 type TNotification struct {
-	Bucketname       string          `json:"bucket"`
+	ID               string          `json:"$id"`
+	Bucketname       string          `json:"$bucketname"`
 	Action           string          `json:"action"`
 	CreatedBy        string          `json:"createdby"`
 	UpdatedBy        string          `json:"updatedby"`
@@ -93,6 +96,7 @@ type TNotification struct {
 	UpdatedTime      uint64          `json:"updatedtime"`
 	CreatedonNetwork string          `json:"createdonnetwork"`
 	CreatedonServer  string          `json:"createdonserver"`
+	Seq              uint64          `json:"$seq"` // id of the row written in the logs by the trigger
 	Data             json.RawMessage `json:"data"` // contain the JSON serialized object to be saved, it will be HTML Sanitized
 }
 
@@ -104,6 +108,64 @@ var sqldb *sql.DB
  */
 var connstring = ""
 
+/* logTriggerSQL create the function that log every change to the objects and
+notify the servers with the $bucketname, $id and $seq of the change.
+*/
+const logTriggerSQL = "CREATE OR REPLACE FUNCTION ecureuil.logtrigger() " +
+	"RETURNS trigger AS " +
+	"$BODY$ " +
+	"DECLARE " +
+	"notification jsonb; " +
+	"logid bigint; " +
+	"BEGIN " +
+	"if (TG_OP = 'DELETE') THEN " +
+	"	insert into ecureuil.logs (timeofaction, jsonid, username, action, previousdata, bucketname)  " +
+	"	VALUES (NOW(), CAST(OLD.data->>'$id' AS UUID), OLD.data->>'$updatedby', TG_OP, OLD.data, OLD.data->>'$bucketname') RETURNING id INTO logid; " +
+	"	notification = jsonb_build_object('action', TG_OP, '$bucketname', OLD.data->>'$bucketname', '$id', OLD.data->>'$id', '$seq', logid); " +
+	"	PERFORM pg_notify('events_ecureuil',notification::text); " +
+	"ELSIF (TG_OP = 'UPDATE') THEN  " +
+	"	insert into ecureuil.logs (timeofaction, jsonid, username, action, previousdata, newdata, bucketname)  " +
+	"	VALUES (NOW(), CAST(NEW.data->>'$id' AS UUID), NEW.data->>'$updatedby', TG_OP, OLD.data, NEW.data, NEW.data->>'$bucketname') RETURNING id INTO logid; " +
+	"	notification = jsonb_build_object('action', TG_OP, '$bucketname', NEW.data->>'$bucketname', '$id', NEW.data->>'$id', '$seq', logid); " +
+	"	PERFORM pg_notify('events_ecureuil',notification::text); " +
+	" ELSIF (TG_OP = 'INSERT') THEN  " +
+	"	insert into ecureuil.logs (timeofaction, jsonid, username, action,  newdata, bucketname)  " +
+	"	VALUES (NOW(), CAST(NEW.data->>'$id' AS UUID), NEW.data->>'$updatedby', TG_OP, NEW.data, NEW.data->>'$bucketname') RETURNING id INTO logid; " +
+	"	notification = jsonb_build_object('action', TG_OP, '$bucketname', NEW.data->>'$bucketname', '$id', NEW.data->>'$id', '$seq', logid); " +
+	"	PERFORM pg_notify('events_ecureuil',notification::text); " +
+	"END IF; " +
+	"RETURN NULL; " +
+	"END; " +
+	"$BODY$ " +
+	"LANGUAGE plpgsql VOLATILE "
+
+/* uniqueIDSQL make the index of $id unique in a database created by an older
+version, an INSERT sent again with the same $id must not create a copy.
+*/
+const uniqueIDSQL = "DO $UPGRADE$ BEGIN " +
+	"IF NOT EXISTS (SELECT 1 FROM pg_index WHERE indexrelid = 'ecureuil.jsonobjects_$id'::regclass AND indisunique) THEN " +
+	"DROP INDEX ecureuil.JSONOBJECTS_$ID; " +
+	"CREATE UNIQUE INDEX JSONOBJECTS_$ID ON ecureuil.JSONOBJECTS (CAST(data->>'$id' AS uuid)); " +
+	"END IF; " +
+	"END $UPGRADE$;"
+
+/* upgradeDB replace the functions of a database created by an older version,
+the servers rely on the $seq sent by the trigger to read the changes from the
+logs.
+*/
+func upgradeDB() {
+
+	_, err := sqldb.Exec(logTriggerSQL)
+	if err != nil {
+		logger.Error("Unable to update ecureuil.logtrigger(), the changes will be sent without $seq: " + err.Error())
+	}
+
+	_, err = sqldb.Exec(uniqueIDSQL)
+	if err != nil {
+		logger.Error("Unable to make the index of $id unique, remove the objects with the same $id: " + err.Error())
+	}
+}
+
 /*Open Function called at the start of the program to open the database.
  */
 func Open(host, username, password string) {
@@ -125,6 +187,9 @@ func Open(host, username, password string) {
 		panic(err.Error())
 	}
 
+	/* install the current version of the trigger */
+	upgradeDB()
+
 	/* Initialize database, create CONFIGURATION with  default values if required */
 	ConfigurationINIT()
 
@@ -262,7 +327,7 @@ func DBCreateIndex(packet *MsgClientCmd) ([]byte, error) {
 
 	DBLog("", packet.Username, "CREATEINDEX", []byte(""), []byte(packet.Key))
 
-	return PrepMessageForUser("Index created"), nil
+	return PrepStatusForUser("indexcreate", "Index created"), nil
 }
 
 /*DBDropIndex this is to drop reate an index on a json property
@@ -302,7 +367,7 @@ func DBDropIndex(packet *MsgClientCmd) ([]byte, error) {
 
 	DBLog("", packet.Username, "DROPINDEX", []byte(""), []byte(packet.Key))
 
-	return PrepMessageForUser("Index " + packet.Key + " dropped"), nil
+	return PrepStatusForUser("indexdrop", "Index "+packet.Key+" dropped"), nil
 
 }
 
@@ -429,13 +494,7 @@ func buildsubquery(item *tquery) string {
 
 func buildQuery(bucketname string, querystring []byte) string {
 
-	validtypes := []string{"BIGINT", "INT", "TEXT", "DECIMAL", "DOUBLE"}
-	searchtypes := []string{"EQ", "GT", "GTE", "LT", "LTE", "BETWEEN"}
-	logicops := []string{"AND", "OR", ""}
-
-	queryItems := []tquery{}
-
-	err := json.Unmarshal(querystring, &queryItems)
+	queryItems, err := parseQuery(querystring)
 	if err != nil {
 		logger.Error("Invalid query items " + string(querystring) + " ERROR = " + err.Error())
 		return ""
@@ -444,33 +503,7 @@ func buildQuery(bucketname string, querystring []byte) string {
 	subquery := ""
 
 	for i := 0; i < len(queryItems); i++ {
-
-		if queryItems[i].Fieldname == "" {
-			return ""
-		}
-		if !IsStrInArray(queryItems[i].Type, validtypes) {
-			return ""
-		}
-		if !IsStrInArray(queryItems[i].Searchtype, searchtypes) {
-			return ""
-		}
-		if !IsStrInArray(queryItems[i].LogicOp, logicops) {
-			return ""
-		}
-		if queryItems[i].Searchtype == "BETWEEN" && len(queryItems[i].Values) != 2 {
-			return ""
-		}
-		if queryItems[i].Searchtype != "BETWEEN" && len(queryItems[i].Values) != 1 {
-			return ""
-		}
-
 		subquery += buildsubquery(&queryItems[i]) + " "
-
-		if i+1 == len(queryItems) && queryItems[i].LogicOp != "" {
-			// last item can't finish with AND or OR
-			return ""
-		}
-
 	}
 
 	return subquery
@@ -577,6 +610,7 @@ func DBRead(packet *MsgClientCmd) ([]byte, error) {
 				logger.Error(err.Error())
 				return nil, err
 			}
+			data = string(Redact(packet.Bucketname, []byte(data)))
 			if count <= 0 {
 				result += data
 			} else {
@@ -730,6 +764,9 @@ func DBDelete(packet *MsgClientCmd, defered bool) ([]byte, error) {
 		}
 
 		if float64(packet.Defered) >= UnixUTCSecs() {
+			if message := checkDefered(HookBeforeDelete, packet); message != nil {
+				return message, nil
+			}
 			return DBDeferAction(packet)
 		}
 
@@ -737,13 +774,39 @@ func DBDelete(packet *MsgClientCmd, defered bool) ([]byte, error) {
 
 	logger.Trace("access granted to delete.")
 
-	_, err = sqldb.Exec("DELETE from ecureuil.JSONOBJECTS WHERE data->>'$id' = $1", packet.Key)
+	// the hooks receive the object that is deleted, they are not called when
+	// the object does not exist
+	var object *gabs.Container
+
+	if hasHooks(packet.Bucketname, HookBeforeDelete, HookAfterDelete) {
+
+		object, err = dbObject(packet.Key)
+		if err != nil {
+			logger.Error(err.Error())
+			return PrepMessageForUser("Error while reading object for " + packet.Bucketname + " " + err.Error()), err
+		}
+
+		if object != nil {
+			if err = runHooks(HookBeforeDelete, packet, object); err != nil {
+				logger.Warn(packet.Username + " delete " + packet.Key + " from " + packet.Bucketname + " refused: " + err.Error())
+				return PrepMessageForUser(err.Error()), nil
+			}
+		}
+	}
+
+	result, err := sqldb.Exec("DELETE from ecureuil.JSONOBJECTS WHERE data->>'$id' = $1", packet.Key)
 
 	if err != nil {
 		logger.Trace(err.Error())
 		return PrepMessageForUser("Error while deleting object for " + packet.Bucketname + " " + err.Error()), nil
 	}
 
+	if object != nil {
+		if deleted, _ := result.RowsAffected(); deleted == 0 {
+			object = nil
+		}
+	}
+
 	// delete associated defered commands
 	_, err = sqldb.Exec("DELETE from ecureuil.DEFEREDCOMMAND WHERE jsonid = $1", packet.Key)
 
@@ -752,6 +815,13 @@ func DBDelete(packet *MsgClientCmd, defered bool) ([]byte, error) {
 		return PrepMessageForUser("Error while deleting defered command for object in " + packet.Bucketname + " " + err.Error()), nil
 	}
 
+	// the object is deleted, an error of the hook can't be a failure of the delete
+	if object != nil {
+		if hookerr := runHooks(HookAfterDelete, packet, object); hookerr != nil {
+			logger.Error(packet.Username + " delete " + packet.Key + " from " + packet.Bucketname + " done, hook error: " + hookerr.Error())
+		}
+	}
+
 	logger.Trace("Delete command successful")
 	return nil, err
 }
@@ -780,6 +850,9 @@ func DBUpdate(packet *MsgClientCmd, defered bool) ([]byte, error) {
 		}
 
 		if float64(packet.Defered) >= UnixUTCSecs() {
+			if message := checkDefered(HookBeforeUpdate, packet); message != nil {
+				return message, nil
+			}
 			return DBDeferAction(packet)
 		}
 	}
@@ -827,14 +900,33 @@ func DBUpdate(packet *MsgClientCmd, defered bool) ([]byte, error) {
 		jsonParsed.SetP(packet.Username, "$updatedby")
 		jsonParsed.SetP(uint64(UnixUTCSecs()), "$updatedtime")
 
+		if err = runHooks(HookBeforeUpdate, packet, jsonParsed); err != nil {
+			logger.Warn(packet.Username + " update " + packet.Key + " in " + packet.Bucketname + " refused: " + err.Error())
+			return PrepMessageForUser(err.Error()), nil
+		}
+
 		sqlquery := "UPDATE ecureuil.JSONOBJECTS set data = $1 WHERE data->>'$id' = $2"
-		_, err = sqldb.Exec(sqlquery, SanitizeJSONStrHTML(jsonParsed.String()), packet.Key)
+		if !statusexists {
+			// an update without the status keep the status saved
+			sqlquery = "UPDATE ecureuil.JSONOBJECTS set data = $1::jsonb || jsonb_strip_nulls(jsonb_build_object('$status', data->'$status', '$itemstatus', data->'$itemstatus')) WHERE data->>'$id' = $2"
+		}
+		result, err := sqldb.Exec(sqlquery, SanitizeJSONStrHTML(jsonParsed.String()), packet.Key)
 
 		if err != nil {
 			logger.Trace(err.Error())
 			return PrepMessageForUser("Error  " + err.Error()), nil
 		}
 
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			logger.Trace("update " + packet.Key + " in " + packet.Bucketname + " no object with this $id")
+			return nil, nil
+		}
+
+		// the object is saved, an error of the hook can't be a failure of the update
+		if hookerr := runHooks(HookAfterUpdate, packet, jsonParsed); hookerr != nil {
+			logger.Error(packet.Username + " update " + packet.Key + " in " + packet.Bucketname + " done, hook error: " + hookerr.Error())
+		}
+
 		// a broadcast will be emited once the database generate a notify event.
 
 	}
@@ -899,6 +991,9 @@ func DBInsert(packet *MsgClientCmd, defered bool) ([]byte, error) {
 		}
 
 		if float64(packet.Defered) >= UnixUTCSecs() {
+			if message := checkDefered(HookBeforeInsert, packet); message != nil {
+				return message, nil
+			}
 			return DBDeferAction(packet)
 		}
 	}
@@ -980,10 +1075,23 @@ func DBInsert(packet *MsgClientCmd, defered bool) ([]byte, error) {
 		jsonParsed.SetP(uint64(UnixUTCSecs()), "$createdtime")
 		jsonParsed.SetP(uint64(UnixUTCSecs()), "$updatedtime")
 
+		if err = runHooks(HookBeforeInsert, packet, jsonParsed); err != nil {
+			logger.Warn(packet.Username + " insert " + ID + " in " + packet.Bucketname + " refused: " + err.Error())
+			return PrepMessageForUser(err.Error()), nil
+		}
+
 		// ID, BUCKETNAME, CREATEDBY, UPDATEDBY, CREATEDTIME, UPDATEDTIME, CREATEDONNETWORK, CREATEDONSERVER, DATA
-		sqlquery := "INSERT into ecureuil.JSONOBJECTS (DATA) VALUES ($1);"
+		// an INSERT sent again by a client that did not receive the reply
+		// change nothing, the object with the $id is already saved.
+		sqlquery := "INSERT into ecureuil.JSONOBJECTS (DATA) SELECT $1 WHERE NOT EXISTS (SELECT 1 FROM ecureuil.JSONOBJECTS WHERE data->>'$id' = $2);"
+
+		result, err := sqldb.Exec(sqlquery, SanitizeJSONStrHTML(jsonParsed.String()), ID)
 
-		_, err = sqldb.Exec(sqlquery, SanitizeJSONStrHTML(jsonParsed.String()))
+		if pqerr, ok := err.(*pq.Error); ok && pqerr.Code == "23505" {
+			// the same INSERT was saved by another connection in between
+			logger.Trace("insert " + ID + " already saved")
+			return nil, nil
+		}
 
 		if err == nil {
 
@@ -995,6 +1103,16 @@ func DBInsert(packet *MsgClientCmd, defered bool) ([]byte, error) {
 			return PrepMessageForUser("Database Error: " + err.Error()), nil
 
 		}
+
+		if inserted, _ := result.RowsAffected(); inserted == 0 {
+			logger.Trace("insert " + ID + " already saved")
+			return nil, nil
+		}
+
+		// the object is saved, an error of the hook can't be a failure of the insert
+		if hookerr := runHooks(HookAfterInsert, packet, jsonParsed); hookerr != nil {
+			logger.Error(packet.Username + " insert " + ID + " in " + packet.Bucketname + " done, hook error: " + hookerr.Error())
+		}
 	}
 
 	if err != nil {
@@ -1177,7 +1295,7 @@ func CreateDB(host, user, pass *string) string {
 		return err.Error()
 	}
 
-	_, err = sqldb.Exec("CREATE INDEX JSONOBJECTS_$ID ON ecureuil.JSONOBJECTS (CAST(data->>'$id' AS uuid));")
+	_, err = sqldb.Exec("CREATE UNIQUE INDEX JSONOBJECTS_$ID ON ecureuil.JSONOBJECTS (CAST(data->>'$id' AS uuid));")
 	if err != nil {
 		return err.Error()
 	}
@@ -1248,32 +1366,7 @@ func CreateDB(host, user, pass *string) string {
 		return err.Error()
 	}
 
-	_, err = sqldb.Exec("CREATE OR REPLACE FUNCTION ecureuil.logtrigger() " +
-		"RETURNS trigger AS " +
-		"$BODY$ " +
-		"DECLARE " +
-		"notification jsonb; " +
-		"BEGIN " +
-		"if (TG_OP = 'DELETE') THEN " +
-		"	notification = OLD.data || jsonb_build_object('action', TG_OP); " +
-		"	insert into ecureuil.logs (timeofaction, jsonid, username, action, previousdata, bucketname)  " +
-		"	VALUES (NOW(), CAST(OLD.data->>'$id' AS UUID), OLD.data->>'$updatedby', TG_OP, OLD.data, OLD.data->>'$bucketname'); " +
-		"	PERFORM pg_notify('events_ecureuil',notification::text); " +
-		"ELSIF (TG_OP = 'UPDATE') THEN  " +
-		"	notification = NEW.data|| jsonb_build_object('action', TG_OP); " +
-		"	insert into ecureuil.logs (timeofaction, jsonid, username, action, previousdata, newdata, bucketname)  " +
-		"	VALUES (NOW(), CAST(NEW.data->>'$id' AS UUID), NEW.data->>'$updatedby', TG_OP, OLD.data, NEW.data, NEW.data->>'$bucketname'); " +
-		"	PERFORM pg_notify('events_ecureuil',notification::text); " +
-		" ELSIF (TG_OP = 'INSERT') THEN  " +
-		"	notification = NEW.data || jsonb_build_object('action', TG_OP); " +
-		"	insert into ecureuil.logs (timeofaction, jsonid, username, action,  newdata, bucketname)  " +
-		"	VALUES (NOW(), CAST(NEW.data->>'$id' AS UUID), NEW.data->>'$updatedby', TG_OP, NEW.data, NEW.data->>'$bucketname'); " +
-		"	PERFORM pg_notify('events_ecureuil',notification::text); " +
-		"END IF; " +
-		"RETURN NULL; " +
-		"END; " +
-		"$BODY$ " +
-		"LANGUAGE plpgsql VOLATILE ")
+	_, err = sqldb.Exec(logTriggerSQL)
 
 	if err != nil {
 		return err.Error()
@@ -1702,6 +1795,84 @@ func runMonitorStatusStartEnd() {
 
 }
 
+/*tChange a change read from the logs, message is the object with the action
+and the $seq added, it is the broadcast sent to the clients.
+*/
+type tChange struct {
+	seq        uint64
+	bucketname string
+	id         string
+	message    []byte
+	previous   []byte
+}
+
+/*dbChangesAfter return the INSERT, UPDATE and DELETE made to the buckets after
+the logs row seq. resync is true when the changes can't be replayed, the logs
+older than the retention are deleted, the sequence come from another database
+or there is more than limit changes.
+*/
+func dbChangesAfter(seq uint64, buckets []string, limit int) (changes []tChange, resync bool, err error) {
+
+	var first, last uint64
+
+	err = sqldb.QueryRow("SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), 0) FROM ecureuil.logs;").Scan(&first, &last)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if seq > last || (first > 0 && seq+1 < first) {
+		return nil, true, nil
+	}
+
+	if len(buckets) == 0 {
+		return changes, false, nil
+	}
+
+	sqlquery := "SELECT id, " + changeColumns + " FROM ecureuil.logs WHERE id > $1 AND action IN ('INSERT', 'UPDATE', 'DELETE') AND lower(bucketname) = ANY($2) ORDER BY id LIMIT $3;"
+
+	logger.Trace(sqlquery)
+
+	rows, err := sqldb.Query(sqlquery, seq, pq.Array(buckets), limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		change := tChange{}
+		if err = rows.Scan(&change.seq, &change.bucketname, &change.id, &change.message, &change.previous); err != nil {
+			return nil, false, err
+		}
+		changes = append(changes, change)
+	}
+
+	if len(changes) > limit {
+		return nil, true, nil
+	}
+
+	return changes, false, rows.Err()
+}
+
+/* changeColumns columns of the logs scanned into a tChange, the object of a
+DELETE is in previousdata.
+*/
+const changeColumns = "bucketname, COALESCE(CAST(jsonid AS text), ''), COALESCE(newdata, previousdata) || jsonb_build_object('action', action, '$seq', id), previousdata"
+
+/*dbChange read the change written in the logs row seq by the trigger, the
+notification only contain the $id and $seq because the payload of pg_notify
+is limited to 8000 bytes.
+*/
+func dbChange(seq uint64) (*tChange, error) {
+
+	change := tChange{seq: seq}
+
+	err := sqldb.QueryRow("SELECT "+changeColumns+" FROM ecureuil.logs WHERE id = $1;", seq).Scan(&change.bucketname, &change.id, &change.message, &change.previous)
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
 /*
 
  */
@@ -1730,12 +1901,31 @@ func waitForNotification(l *pq.Listener) error {
 			if Notification.Action == "DELETE" || Notification.Action == "UPDATE" || Notification.Action == "INSERT" {
 
 				logger.Trace("Receive event from POSTGRESQL: " + Notification.Action + " for bucket: " + Notification.Bucketname + " " + string(n.Extra))
-				BroadcastPut(Notification.Bucketname, n.Extra)
 
-			}
+				// the rights of the users must be verified again before the next broadcast
+				if IsStrInArray(Notification.Bucketname, RightsBuckets) {
+					RefreshRightsCache()
+				}
 
-			if Notification.Action == "UPDATE" || Notification.Action == "INSERT" {
-				GenerateEmailTemplate(Notification.Bucketname, n.Extra)
+				// the object is read from the logs, previous is use by the filtered registrations.
+				// A database created before the trigger sent $seq notify the whole object.
+				message, previous := []byte(n.Extra), []byte(nil)
+				if Notification.Seq > 0 {
+					change, err := dbChange(Notification.Seq)
+					if err != nil {
+						// the clients would miss the change, they must reload their data
+						logger.Error("Unable to read change " + strconv.FormatUint(Notification.Seq, 10) + " of " + Notification.ID + " " + err.Error())
+						BroadcastResync(Notification.Bucketname, Notification.ID)
+						return nil
+					}
+					message, previous = change.message, change.previous
+				}
+
+				BroadcastPutChange(Notification.Bucketname, Notification.ID, message, previous)
+
+				if Notification.Action == "UPDATE" || Notification.Action == "INSERT" {
+					GenerateEmailTemplate(Notification.Bucketname, string(message))
+				}
 			}
 
 			return nil
@@ -98,7 +98,7 @@ func ReceiveEmailAlertChangeReq(packet *MsgClientCmd) ([]byte, error) {
 		Configuration.EmailAlertSubject,
 		Configuration.EmailAlertBody+"\n\n https://"+Configuration.Addr+"/confirm/?ID="+Info.ID)
 
-	return PrepMessageForUser("A confirmation request has been sent to your email address."), nil
+	return PrepStatusForUser("emailalert", "A confirmation request has been sent to your email address."), nil
 
 }
 
@@ -0,0 +1,201 @@
+/*
+______________________________________________________________________________
+
+ Ecureuil - Web framework for real-time javascript app.
+_____________________________________________________________________________
+
+MIT License
+
+Copyright (c) 2014-2016 Marc Gauthier
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+______________________________________________________________________________
+
+
+This file contain the functions to validate the conditions of a QUERY and to
+evaluate them on a JSON object in memory, they are use to filter the
+broadcasts sent to a client that registered to a bucket with conditions.
+
+______________________________________________________________________________
+
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/Jeffail/gabs"
+)
+
+/*parseQuery decode and validate the conditions of a QUERY, the same format is
+use to filter the events of a REGISTEREVENT.
+*/
+func parseQuery(querystring []byte) ([]tquery, error) {
+
+	validtypes := []string{"BIGINT", "INT", "TEXT", "DECIMAL", "DOUBLE"}
+	searchtypes := []string{"EQ", "GT", "GTE", "LT", "LTE", "BETWEEN"}
+	logicops := []string{"AND", "OR", ""}
+
+	queryItems := []tquery{}
+
+	err := json.Unmarshal(querystring, &queryItems)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(queryItems) == 0 {
+		return nil, errors.New("No condition provided")
+	}
+
+	for i := 0; i < len(queryItems); i++ {
+
+		if queryItems[i].Fieldname == "" {
+			return nil, errors.New("Property of condition " + strconv.Itoa(i+1) + " is empty")
+		}
+		if !IsStrInArray(queryItems[i].Type, validtypes) {
+			return nil, errors.New("Invalid type " + queryItems[i].Type)
+		}
+		if !IsStrInArray(queryItems[i].Searchtype, searchtypes) {
+			return nil, errors.New("Invalid search type " + queryItems[i].Searchtype)
+		}
+		if !IsStrInArray(queryItems[i].LogicOp, logicops) {
+			return nil, errors.New("Invalid logic " + queryItems[i].LogicOp)
+		}
+		if queryItems[i].Searchtype == "BETWEEN" && len(queryItems[i].Values) != 2 {
+			return nil, errors.New("BETWEEN require two values")
+		}
+		if queryItems[i].Searchtype != "BETWEEN" && len(queryItems[i].Values) != 1 {
+			return nil, errors.New(queryItems[i].Searchtype + " require one value")
+		}
+		if i+1 == len(queryItems) && queryItems[i].LogicOp != "" {
+			// last item can't finish with AND or OR
+			return nil, errors.New("Last condition can't finish with " + queryItems[i].LogicOp)
+		}
+	}
+
+	return queryItems, nil
+}
+
+/*matchQuery evaluate the conditions on a JSON object, AND take precedence over
+OR like it does in SQL.
+*/
+func matchQuery(queryItems []tquery, item *gabs.Container) bool {
+
+	result := false
+	term := true
+
+	for i := range queryItems {
+
+		term = term && queryItems[i].match(item)
+
+		if queryItems[i].LogicOp != "AND" {
+			result = result || term
+			term = true
+		}
+	}
+
+	return result
+}
+
+/*match evaluate one condition, a property that does not exist never match
+like a NULL in SQL.
+*/
+func (q *tquery) match(item *gabs.Container) bool {
+
+	cmp := func(value string) (int, bool) {
+		return compareProperty(item, q.Fieldname, q.Type, value)
+	}
+
+	switch q.Searchtype {
+
+	case "BETWEEN":
+		low, ok := cmp(q.Values[0])
+		if !ok {
+			return false
+		}
+		high, ok := cmp(q.Values[1])
+		return ok && low >= 0 && high <= 0
+
+	default:
+		r, ok := cmp(q.Values[0])
+		if !ok {
+			return false
+		}
+		switch q.Searchtype {
+		case "EQ":
+			return r == 0
+		case "GT":
+			return r > 0
+		case "GTE":
+			return r >= 0
+		case "LT":
+			return r < 0
+		case "LTE":
+			return r <= 0
+		}
+	}
+
+	return false
+}
+
+/*compareProperty compare a property of an object with a value the same way
+CAST(property AS fieldtype) would, return false if the property does not exist
+or can't be converted.
+*/
+func compareProperty(item *gabs.Container, field, fieldtype, value string) (int, bool) {
+
+	var property string
+
+	switch v := item.Path(field).Data().(type) {
+	case string:
+		property = v
+	case float64:
+		property = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		property = strconv.FormatBool(v)
+	default:
+		return 0, false
+	}
+
+	if strings.ToUpper(fieldtype) == "TEXT" {
+		return strings.Compare(property, value), true
+	}
+
+	p, err := strconv.ParseFloat(property, 64)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	switch {
+	case p < v:
+		return -1, true
+	case p > v:
+		return 1, true
+	}
+	return 0, true
+}
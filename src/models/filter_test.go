@@ -0,0 +1,169 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/Jeffail/gabs"
+)
+
+/* condition build the JSON of one condition of a query. */
+func condition(property, fieldtype, searchtype, logic string, values ...string) string {
+	quoted := ""
+	for i, v := range values {
+		if i > 0 {
+			quoted += ","
+		}
+		quoted += `"` + v + `"`
+	}
+	return `{"property":"` + property + `","type":"` + fieldtype + `","st":"` + searchtype + `","values":[` + quoted + `],"logic":"` + logic + `"}`
+}
+
+func TestParseQuery(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		query string
+		valid bool
+	}{
+		{"one condition", `[` + condition("level", "INT", "EQ", "", "1") + `]`, true},
+		{"and", `[` + condition("level", "INT", "EQ", "AND", "1") + `,` + condition("city", "TEXT", "EQ", "", "Ottawa") + `]`, true},
+		{"between", `[` + condition("level", "INT", "BETWEEN", "", "1", "3") + `]`, true},
+		{"not json", `level = 1`, false},
+		{"empty", `[]`, false},
+		{"no property", `[` + condition("", "INT", "EQ", "", "1") + `]`, false},
+		{"invalid type", `[` + condition("level", "DATE", "EQ", "", "1") + `]`, false},
+		{"invalid search type", `[` + condition("level", "INT", "LIKE", "", "1") + `]`, false},
+		{"invalid logic", `[` + condition("level", "INT", "EQ", "XOR", "1") + `]`, false},
+		{"between one value", `[` + condition("level", "INT", "BETWEEN", "", "1") + `]`, false},
+		{"two values", `[` + condition("level", "INT", "EQ", "", "1", "2") + `]`, false},
+		{"last with logic", `[` + condition("level", "INT", "EQ", "AND", "1") + `]`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseQuery([]byte(test.query))
+			if (err == nil) != test.valid {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMatchQuery(t *testing.T) {
+
+	item, err := gabs.ParseJSON([]byte(`{"level":2,"city":"Ottawa","open":true,"count":"10","address":{"zip":"K1A"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		conditions []string
+		match      bool
+	}{
+		{"eq", []string{condition("level", "INT", "EQ", "", "2")}, true},
+		{"not eq", []string{condition("level", "INT", "EQ", "", "3")}, false},
+		{"gt", []string{condition("level", "INT", "GT", "", "1")}, true},
+		{"gte", []string{condition("level", "INT", "GTE", "", "2")}, true},
+		{"lt", []string{condition("level", "INT", "LT", "", "2")}, false},
+		{"lte", []string{condition("level", "INT", "LTE", "", "2")}, true},
+		{"between", []string{condition("level", "INT", "BETWEEN", "", "1", "3")}, true},
+		{"outside between", []string{condition("level", "INT", "BETWEEN", "", "3", "5")}, false},
+		{"missing property", []string{condition("missing", "TEXT", "EQ", "", "")}, false},
+		{"dot path", []string{condition("address.zip", "TEXT", "EQ", "", "K1A")}, true},
+		{"dot path missing", []string{condition("address.city", "TEXT", "EQ", "", "K1A")}, false},
+
+		// the values are converted like CAST(property AS type)
+		{"text number", []string{condition("level", "TEXT", "EQ", "", "2")}, true},
+		{"number text", []string{condition("count", "INT", "GT", "", "9")}, true},
+		{"number compared as text", []string{condition("count", "TEXT", "GT", "", "9")}, false},
+		{"decimal", []string{condition("level", "DECIMAL", "EQ", "", "2.0")}, true},
+		{"bool", []string{condition("open", "TEXT", "EQ", "", "true")}, true},
+		{"text not a number", []string{condition("city", "INT", "EQ", "", "0")}, false},
+		{"value not a number", []string{condition("level", "INT", "EQ", "", "two")}, false},
+
+		{"and", []string{condition("level", "INT", "EQ", "AND", "2"), condition("city", "TEXT", "EQ", "", "Ottawa")}, true},
+		{"and false", []string{condition("level", "INT", "EQ", "AND", "2"), condition("city", "TEXT", "EQ", "", "Paris")}, false},
+		{"or", []string{condition("level", "INT", "EQ", "OR", "3"), condition("city", "TEXT", "EQ", "", "Ottawa")}, true},
+		{"or false", []string{condition("level", "INT", "EQ", "OR", "3"), condition("city", "TEXT", "EQ", "", "Paris")}, false},
+
+		// AND take precedence over OR, a AND b OR c is (a AND b) OR c
+		{"and before or", []string{
+			condition("level", "INT", "EQ", "AND", "3"),
+			condition("city", "TEXT", "EQ", "OR", "Ottawa"),
+			condition("open", "TEXT", "EQ", "", "true"),
+		}, true},
+		{"or before and", []string{
+			condition("open", "TEXT", "EQ", "OR", "true"),
+			condition("level", "INT", "EQ", "AND", "3"),
+			condition("city", "TEXT", "EQ", "", "Paris"),
+		}, true},
+		{"or of and false", []string{
+			condition("open", "TEXT", "EQ", "AND", "false"),
+			condition("level", "INT", "EQ", "OR", "2"),
+			condition("level", "INT", "EQ", "AND", "3"),
+			condition("city", "TEXT", "EQ", "", "Ottawa"),
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := "["
+			for i, c := range test.conditions {
+				if i > 0 {
+					query += ","
+				}
+				query += c
+			}
+			query += "]"
+
+			conditions, err := parseQuery([]byte(query))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matchQuery(conditions, item) != test.match {
+				t.Fatal(query)
+			}
+		})
+	}
+}
+
+func TestAcceptUpdate(t *testing.T) {
+
+	conditions, err := parseQuery([]byte(`[` + condition("level", "INT", "GTE", "", "3") + `]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered := []*tRegistration{{key: "level", filter: conditions}}
+
+	tests := []struct {
+		name     string
+		message  string
+		previous string
+		accept   bool
+	}{
+		{"insert match", `{"level":3}`, "", true},
+		{"insert no match", `{"level":1}`, "", false},
+		{"match after", `{"level":3}`, `{"level":1}`, true},
+		{"match before", `{"level":1}`, `{"level":3}`, true},
+		{"match before and after", `{"level":4}`, `{"level":3}`, true},
+		{"no match before or after", `{"level":1}`, `{"level":2}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &TBroadcast{Bucketname: "INCIDENTS", Message: []byte(test.message)}
+			if test.previous != "" {
+				b.Previous = []byte(test.previous)
+			}
+			if (&tParsedBroadcast{broadcast: b}).accept(filtered) != test.accept {
+				t.Fatal(test.message, test.previous)
+			}
+
+			// a registration without filter accept everything
+			if !(&tParsedBroadcast{broadcast: b}).accept([]*tRegistration{{}, filtered[0]}) {
+				t.Fatal("not accepted without filter")
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+/*
+______________________________________________________________________________
+
+ Ecureuil - Web framework for real-time javascript app.
+_____________________________________________________________________________
+
+MIT License
+
+Copyright (c) 2014-2016 Marc Gauthier
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+______________________________________________________________________________
+
+
+This file contain the hooks an application embedding this package can
+register to validate, enrich or refuse the objects of a bucket before they
+are saved into ecureuil.JSONOBJECTS, and to react once they are saved.
+
+	models.RegisterHook("INVOICES", models.HookBeforeInsert, func(packet *models.MsgClientCmd, object *gabs.Container) error {
+		if _, ok := object.Path("total").Data().(float64); !ok {
+			return errors.New("An invoice need a total.")
+		}
+		return nil
+	})
+
+The hooks are called for the commands received from the clients and for the
+defered commands when they are executed, the before hooks are also called
+when a command is defered so it is refused right away. The special bucket
+USERS does not call the hooks and the delete hooks are not called when the
+object does not exist.
+
+______________________________________________________________________________
+
+*/
+
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+
+	"github.com/Jeffail/gabs"
+	"github.com/antigloss/go/logger"
+)
+
+/*THookEvent when a hook is called.
+ */
+type THookEvent string
+
+/*Hook events, a before hook can modify the object or refuse the change, an
+after hook is called once the change is saved, not when no object was changed.
+*/
+const (
+	HookBeforeInsert THookEvent = "BEFOREINSERT"
+	HookAfterInsert  THookEvent = "AFTERINSERT"
+	HookBeforeUpdate THookEvent = "BEFOREUPDATE"
+	HookAfterUpdate  THookEvent = "AFTERUPDATE"
+	HookBeforeDelete THookEvent = "BEFOREDELETE"
+	HookAfterDelete  THookEvent = "AFTERDELETE"
+)
+
+/*THook is called with the command and the object inserted, updated or
+deleted, including the $ properties. The error of a before hook refuse the
+change and is sent to the user, the error of an after hook is only logged
+since the change is already saved.
+*/
+type THook func(packet *MsgClientCmd, object *gabs.Container) error
+
+/* hooks registered per lowercase bucket name and event. */
+var hooks = struct {
+	sync.RWMutex
+	registered map[string]map[THookEvent][]THook
+}{registered: make(map[string]map[THookEvent][]THook)}
+
+/*RegisterHook add a hook called for an event of the bucket, the hooks of an
+event are called in the order they were registered. The bucket name is not
+case sensitive.
+*/
+func RegisterHook(bucketname string, event THookEvent, hook THook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+
+	bucketname = strings.ToLower(bucketname)
+
+	if hooks.registered[bucketname] == nil {
+		hooks.registered[bucketname] = make(map[THookEvent][]THook)
+	}
+	hooks.registered[bucketname][event] = append(hooks.registered[bucketname][event], hook)
+}
+
+/* hasHooks return true if one of the events of the bucket has a hook. */
+func hasHooks(bucketname string, events ...THookEvent) bool {
+	hooks.RLock()
+	defer hooks.RUnlock()
+
+	for _, event := range events {
+		if len(hooks.registered[strings.ToLower(bucketname)][event]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/* runHooks call the hooks of the event, the first error stop the calls. */
+func runHooks(event THookEvent, packet *MsgClientCmd, object *gabs.Container) error {
+
+	hooks.RLock()
+	registered := hooks.registered[strings.ToLower(packet.Bucketname)][event]
+	hooks.RUnlock()
+
+	for _, hook := range registered {
+		if err := hook(packet, object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* checkDefered call the before hook of a command that is defered, the
+object given to the hook is not saved, the hook is called again when the
+command is executed. Return the message for the user if the hook refuse the
+command, nil otherwise.
+*/
+func checkDefered(event THookEvent, packet *MsgClientCmd) []byte {
+
+	if !hasHooks(packet.Bucketname, event) {
+		return nil
+	}
+
+	var object *gabs.Container
+	var err error
+
+	if event == HookBeforeDelete {
+		object, err = dbObject(packet.Key)
+		if err == nil && object == nil {
+			return nil
+		}
+	} else {
+		object, err = gabs.ParseJSON(packet.Data)
+	}
+
+	if err != nil {
+		logger.Error(err.Error())
+		return PrepMessageForUser("Error while reading object for " + packet.Bucketname + " " + err.Error())
+	}
+
+	if err = runHooks(event, packet, object); err != nil {
+		logger.Warn(packet.Username + " defer " + packet.Action + " " + packet.Key + " in " + packet.Bucketname + " refused: " + err.Error())
+		return PrepMessageForUser(err.Error())
+	}
+	return nil
+}
+
+/* dbObject read the object $id from ecureuil.JSONOBJECTS, nil if it does
+not exist.
+*/
+func dbObject(id string) (*gabs.Container, error) {
+
+	var data []byte
+
+	err := sqldb.QueryRow("SELECT data FROM ecureuil.JSONOBJECTS WHERE data->>'$id' = $1", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gabs.ParseJSON(data)
+}
@@ -44,16 +44,42 @@ ______________________________________________________________________________
 package models
 
 import (
+	"bytes"
 	"encoding/json"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/Jeffail/gabs"
 	"github.com/antigloss/go/logger"
 	"github.com/gorilla/websocket"
 )
 
 const websocketBufferSize = 8192
 
+/* limits of the websocket connections use when they are not set in the configuration */
+const (
+	defaultPingInterval   = 30 // seconds
+	defaultPongTimeout    = 60 // seconds
+	defaultWriteTimeout   = 10 // seconds
+	defaultMaxMessageSize = 1 << 20
+)
+
+/* configDuration return seconds as a duration, or value seconds if not set. */
+func configDuration(seconds, value int) time.Duration {
+	if seconds <= 0 {
+		seconds = value
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*ProtocolVersion version of the websocket protocol spoken by the server, a client
+can send its version with the LOGIN command and the server reply with its own
+version. A LOGIN without version is accepted for older clients.
+*/
+const ProtocolVersion = 1
+
 /*MsgClientCmd Structure use by the client to send command to the backend.
  */
 type MsgClientCmd struct {
@@ -67,38 +93,251 @@ type MsgClientCmd struct {
 	Field       string          `json:"field"`       // use with Key parameter for  FindOne and FindMany to get the data.
 	Defered     uint64          `json:"defered"`     // execute command at a later date
 	Data        json.RawMessage `json:"data"`        // contain the JSON serialized object to be saved, it will be HTML Sanitized
+	RequestID   string          `json:"requestid"`   // optional, echoed on every reply so the client can match it with the command
+	Version     int             `json:"version"`     // protocol version of the client, only use with LOGIN
 }
 
 /*Hub Structure to manage Hub ressources.
  */
 type Hub struct {
-	clients      map[*Client]bool // list of client in the hub
-	broadcast    chan []byte      // broadcast channel
-	addClient    chan *Client     // func to add client in the hub
-	removeClient chan *Client     // func to remove client from the hub
+	clients      map[*Client]bool            // list of client in the hub
+	buckets      map[string]map[*Client]bool // clients registered to each bucket, by lowercase bucket name
+	broadcast    chan *TBroadcast            // broadcast channel
+	addClient    chan *Client                // func to add client in the hub
+	removeClient chan *Client                // func to remove client from the hub
+	subscribe    chan *tSubscription         // func to register or unregister a client to a bucket
+	watchers     map[string]map[*Client]bool // clients watching each object, by $id
+	watch        chan *tWatch                // func to watch or unwatch objects
+	snapshot     chan *tSnapshot             // func to copy the registrations of a client
+	online       map[string]int              // websockets of each logged user
+	present      map[string]*tPresent        // users registered to each bucket, by lowercase bucket name
+	listeners    map[string]map[*Client]bool // clients receiving the presence events of each bucket, "" for join and leave
+	presence     chan *tPresence             // func to list the users present and start or stop the events
+	identify     chan *Client                // func to update the presence when a client login or logout
+	metrics      chan chan []TClientMetrics
+}
+
+/*tWatch request to add or remove a client from the clients watching objects,
+done is closed once the hub has updated the index.
+*/
+type tWatch struct {
+	client     *Client
+	bucketname string
+	ids        []string
+	register   bool
+	done       chan struct{}
+}
+
+/*tSnapshot copy of the registrations, the objects watched and the presence
+events of a client, use to replay the changes missed. done is closed once the
+hub has filled it.
+*/
+type tSnapshot struct {
+	client    *Client
+	buckets   map[string][]*tRegistration
+	watching  map[string]string // lowercase bucket name by $id
+	listening []string          // lowercase bucket name of the presence events
+	done      chan struct{}
+}
+
+/*tWatched object watched by a client, a client can watch the same object many
+times, it must unwatch it the same number of times.
+*/
+type tWatched struct {
+	bucketname string // lowercase name of the bucket the rights were checked for
+	count      int
+}
+
+/*tSubscription request to add or remove a client from the clients registered to
+a bucket, done is closed once the hub has updated the index.
+*/
+type tSubscription struct {
+	client     *Client
+	bucketname string
+	register   bool
+	filter     *tRegistration
+	done       chan struct{}
+}
+
+/*tRegistration one REGISTEREVENT of a client, only the changes that match the
+conditions of the filter are sent. An empty filter match everything.
+*/
+type tRegistration struct {
+	key    string   // conditions in JSON, use to find the registration to remove
+	filter []tquery // conditions of the registration
+}
+
+/*tParsedBroadcast parse the objects of a broadcast once and only if a filter
+need them.
+*/
+type tParsedBroadcast struct {
+	broadcast *TBroadcast
+	parsed    bool
+	item      *gabs.Container
+	previous  *gabs.Container
+}
+
+/*accept return true if one of the registrations of a client accept the
+broadcast, an UPDATE is accepted if the new or the previous version of the
+object match.
+*/
+func (p *tParsedBroadcast) accept(registrations []*tRegistration) bool {
+
+	for _, r := range registrations {
+
+		if len(r.filter) == 0 {
+			return true
+		}
+
+		if !p.parsed {
+			p.parsed = true
+			p.item, _ = gabs.ParseJSON(p.broadcast.Message)
+			if p.broadcast.Previous != nil {
+				p.previous, _ = gabs.ParseJSON(p.broadcast.Previous)
+			}
+		}
+
+		if (p.item != nil && matchQuery(r.filter, p.item)) || (p.previous != nil && matchQuery(r.filter, p.previous)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*TClientMetrics statistics of the queue of messages of one websocket client.
+ */
+type TClientMetrics struct {
+	Username string `json:"username"`
+	Address  string `json:"address"`  // remote address of the websocket
+	Queued   int    `json:"queued"`   // messages waiting to be sent
+	Capacity int    `json:"capacity"` // size of the queue
+	Sent     uint64 `json:"sent"`     // messages sent
+	Dropped  uint64 `json:"dropped"`  // broadcasts dropped because the queue was full
+	Resyncs  uint64 `json:"resyncs"`  // resync messages sent
 }
 
 /*hub initialize a new hub
  */
 var hub = Hub{
-	broadcast:    make(chan []byte),
+	broadcast:    make(chan *TBroadcast),
 	addClient:    make(chan *Client),
 	removeClient: make(chan *Client),
+	subscribe:    make(chan *tSubscription),
+	watchers:     make(map[string]map[*Client]bool),
+	watch:        make(chan *tWatch),
+	snapshot:     make(chan *tSnapshot),
+	online:       make(map[string]int),
+	present:      make(map[string]*tPresent),
+	listeners:    make(map[string]map[*Client]bool),
+	presence:     make(chan *tPresence),
+	identify:     make(chan *Client),
+	metrics:      make(chan chan []TClientMetrics),
 	clients:      make(map[*Client]bool),
+	buckets:      make(map[string]map[*Client]bool),
 }
 
-/*getBucket extract the name of the bucket from the message and return the
-message
+/*updateSubscription add or remove a client from the clients registered to a
+bucket. A client can register many times to the same bucket, it must
+unregister the same number of times. An unregister remove the last
+registration with the same filter, without filter the last registration is
+removed if none match.
 */
-func getBucket(s []byte) (string, []byte) {
-	bucket := ""
-	for i := 0; i < len(s); i++ {
-		if s[i] == byte(':') {
-			return bucket, s[i+1:]
+func (hub *Hub) updateSubscription(sub *tSubscription) {
+
+	name := strings.ToLower(sub.bucketname)
+	conn := sub.client
+
+	if sub.register {
+		if len(conn.buckets[name]) == 0 {
+			hub.enter(conn.present, name, sub.bucketname)
+		}
+		conn.buckets[name] = append(conn.buckets[name], sub.filter)
+		if hub.buckets[name] == nil {
+			hub.buckets[name] = make(map[*Client]bool)
 		}
-		bucket += string(s[i])
+		hub.buckets[name][conn] = true
+		return
+	}
+
+	registrations := conn.buckets[name]
+	if len(registrations) == 0 {
+		return
+	}
+
+	i := len(registrations) - 1
+	for j := len(registrations) - 1; j >= 0; j-- {
+		if registrations[j].key == sub.filter.key {
+			i = j
+			break
+		}
+	}
+	if registrations[i].key != sub.filter.key && sub.filter.key != "" {
+		// no registration with this filter
+		return
+	}
+
+	conn.buckets[name] = append(registrations[:i], registrations[i+1:]...)
+
+	if len(conn.buckets[name]) == 0 {
+		delete(conn.buckets, name)
+		hub.unindex(conn, name)
+		hub.exit(conn.present, name)
+	}
+}
+
+/*updateWatch add or remove a client from the clients watching objects.
+ */
+func (hub *Hub) updateWatch(w *tWatch) {
+
+	name := strings.ToLower(w.bucketname)
+	conn := w.client
+
+	for _, id := range w.ids {
+
+		watched := conn.watching[id]
+
+		if w.register {
+			if watched == nil || watched.bucketname != name {
+				// watching the same object in another bucket replace it
+				watched = &tWatched{bucketname: name}
+				conn.watching[id] = watched
+			}
+			watched.count++
+			if hub.watchers[id] == nil {
+				hub.watchers[id] = make(map[*Client]bool)
+			}
+			hub.watchers[id][conn] = true
+			continue
+		}
+
+		if watched == nil || watched.bucketname != name {
+			continue
+		}
+		watched.count--
+		if watched.count <= 0 {
+			delete(conn.watching, id)
+			hub.unwatch(conn, id)
+		}
+	}
+}
+
+/*unwatch remove a client from the clients watching an object.
+ */
+func (hub *Hub) unwatch(conn *Client, id string) {
+	delete(hub.watchers[id], conn)
+	if len(hub.watchers[id]) == 0 {
+		delete(hub.watchers, id)
+	}
+}
+
+/*unindex remove a client from the clients registered to a bucket.
+ */
+func (hub *Hub) unindex(conn *Client, name string) {
+	delete(hub.buckets[name], conn)
+	if len(hub.buckets[name]) == 0 {
+		delete(hub.buckets, name)
 	}
-	return "", s
 }
 
 /*start hub and Runs forever as a goroutine
@@ -115,33 +354,182 @@ func (hub *Hub) start() {
 			// remove a client
 			if _, ok := hub.clients[conn]; ok {
 				delete(hub.clients, conn)
+				hub.absent(conn)
+				for name := range conn.listening {
+					hub.unlisten(conn, name)
+				}
+				for name := range conn.buckets {
+					hub.unindex(conn, name)
+				}
+				for id := range conn.watching {
+					hub.unwatch(conn, id)
+				}
 				close(conn.send)
 			}
-		case message := <-hub.broadcast:
-			// broadcast a message to all clients that have register to the bucket "EVENTNAME"
+		case sub := <-hub.subscribe:
+			hub.updateSubscription(sub)
+			close(sub.done)
+		case w := <-hub.watch:
+			hub.updateWatch(w)
+			close(w.done)
+		case p := <-hub.presence:
+			hub.updatePresence(p)
+			close(p.done)
+		case conn := <-hub.identify:
+			hub.rename(conn)
+		case snap := <-hub.snapshot:
+			for name, registrations := range snap.client.buckets {
+				snap.buckets[name] = append([]*tRegistration(nil), registrations...)
+			}
+			for id, watched := range snap.client.watching {
+				snap.watching[id] = watched.bucketname
+			}
+			for name := range snap.client.listening {
+				snap.listening = append(snap.listening, name)
+			}
+			close(snap.done)
+		case b := <-hub.broadcast:
+			hub.send(b)
+		case reply := <-hub.metrics:
+			metrics := make([]TClientMetrics, 0, len(hub.clients))
 			for conn := range hub.clients {
+				metrics = append(metrics, TClientMetrics{
+					Username: conn.loggedUser(),
+					Address:  conn.ws.RemoteAddr().String(),
+					Queued:   len(conn.send),
+					Capacity: cap(conn.send),
+					Sent:     atomic.LoadUint64(&conn.sent),
+					Dropped:  atomic.LoadUint64(&conn.dropped),
+					Resyncs:  atomic.LoadUint64(&conn.resyncs),
+				})
+			}
+			reply <- metrics
+		}
+	}
+}
 
-				b, msg := getBucket(message)
+/*send deliver a broadcast to all clients that have register to the bucket and
+that can still read it, or to every client when the broadcast has no bucket.
+*/
+func (hub *Hub) send(b *TBroadcast) {
 
-				if b == "" || IsStrInArray(b, conn.registerEvents) {
+	if b.Bucketname == "" {
+		for conn := range hub.clients {
+			hub.deliver(conn, b.Message)
+		}
+		return
+	}
 
-					select {
-					case conn.send <- msg:
-					default:
-						// oups! no message sent
-						// pause 1/100 of second and try again
-						time.Sleep(10 * time.Millisecond)
+	name := strings.ToLower(b.Bucketname)
+	if b.Resync {
+		hub.resync(name, b)
+		return
+	}
+	parsed := &tParsedBroadcast{broadcast: b}
+	message := Redact(b.Bucketname, b.Message)
+	if message == nil {
+		return
+	}
+	for conn := range hub.buckets[name] {
+		if parsed.accept(conn.buckets[name]) && conn.canRead(b.Bucketname) {
+			hub.deliver(conn, message)
+		}
+	}
 
-						// send blocking!
-						conn.send <- msg
-					}
-				}
+	// clients watching the object that did not already receive it
+	for conn := range hub.watchers[b.ID] {
+		if watched := conn.watching[b.ID]; watched == nil || watched.bucketname != name {
+			continue
+		}
+		if hub.buckets[name][conn] && parsed.accept(conn.buckets[name]) {
+			continue
+		}
+		if conn.canRead(b.Bucketname) {
+			hub.deliver(conn, message)
+		}
+	}
+}
 
-			}
+/*resync send the resync message to the clients registered to the bucket,
+whatever their filter, and to the clients watching the object.
+*/
+func (hub *Hub) resync(name string, b *TBroadcast) {
+
+	for conn := range hub.buckets[name] {
+		if conn.canRead(b.Bucketname) {
+			hub.deliver(conn, resyncMessage)
 		}
 	}
+
+	for conn := range hub.watchers[b.ID] {
+		if watched := conn.watching[b.ID]; watched == nil || watched.bucketname != name || hub.buckets[name][conn] {
+			continue
+		}
+		if conn.canRead(b.Bucketname) {
+			hub.deliver(conn, resyncMessage)
+		}
+	}
+}
+
+/*deliver queue a broadcast for a client without blocking, a client that is too
+slow to empty its queue can't stall the hub. Depending on SlowClientPolicy the
+broadcast is dropped and the client is told to resync, or the client is
+disconnected.
+*/
+func (hub *Hub) deliver(conn *Client, msg []byte) {
+
+	if conn.closing {
+		return
+	}
+
+	select {
+	case conn.send <- msg:
+		return
+	default:
+	}
+
+	atomic.AddUint64(&conn.dropped, 1)
+
+	if Configuration.SlowClientPolicy == SlowClientDisconnect {
+		logger.Warn("Client " + conn.loggedUser() + " is too slow to receive broadcasts, disconnecting")
+		conn.closing = true
+		// the read function will fail and remove the client from the hub
+		conn.ws.Close()
+		return
+	}
+
+	// the write function send the resync message once it get to it
+	if atomic.AddInt32(&conn.overflow, 1) == 1 {
+		logger.Warn("Client " + conn.loggedUser() + " is too slow to receive broadcasts, dropping messages")
+	}
 }
 
+/*HubMetrics return the statistics of the queue of every websocket client.
+ */
+func HubMetrics() []TClientMetrics {
+	reply := make(chan []TClientMetrics)
+	hub.metrics <- reply
+	return <-reply
+}
+
+/* statsAction reply to STATS with the statistics of the websocket clients, the
+user need the stats-read right.
+*/
+func statsAction(c *Client, packet *MsgClientCmd) ([]byte, error) {
+
+	clients, err := json.Marshal(HubMetrics())
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte("{\"action\":\"stats\", \"server\":{\"clients\":" + string(clients) + "}}"), nil
+}
+
+/*resyncMessage sent to a client after broadcasts were dropped, the data it has
+in memory is no longer up to date.
+*/
+var resyncMessage = []byte("{\"action\":\"resync\", \"message\":\"Some changes could not be sent, reload your data.\"}")
+
 /*HubStart Start the functions that monitor for activities.
  */
 func HubStart() {
@@ -159,13 +547,12 @@ func checkforBroadcast() {
 	for {
 
 		// send all messages until the queue is empty
-		var msg []byte
-
 		for {
-			if msg = BroadcastGet(); msg == nil {
+			b := BroadcastGet()
+			if b == nil {
 				break
 			}
-			hub.broadcast <- msg
+			hub.broadcast <- b
 		}
 
 		// queue is empty take a 1/4 sec pause.
@@ -183,12 +570,21 @@ func ClientAdd(conn *websocket.Conn) {
 
 	// create client struct
 
+	size := Configuration.ClientQueueSize
+	if size <= 0 {
+		size = websocketBufferSize
+	}
+
 	client := &Client{
-		ws:             conn,
-		send:           make(chan []byte, websocketBufferSize),
-		registerEvents: []string{},
-		password:       "",
-		username:       "",
+		ws:        conn,
+		send:      make(chan []byte, size),
+		done:      make(chan struct{}),
+		buckets:   map[string][]*tRegistration{},
+		watching:  map[string]*tWatched{},
+		listening: map[string]bool{},
+		limiter:   map[string]*tTokenBucket{},
+		password:  "",
+		username:  "",
 	}
 
 	// add client in the hub
@@ -208,11 +604,65 @@ func ClientAdd(conn *websocket.Conn) {
 type Client struct {
 	ws *websocket.Conn
 	// Hub passes broadcast messages to this channel
-	send           chan []byte
-	registerEvents []string
-	username       string
-	password       string
-	LoginAttempts  []uint64 // contain the time when login attempt was made.
+	send          chan []byte
+	done          chan struct{} // closed when write exit, nothing is sent anymore
+	buckets       map[string][]*tRegistration // registrations by lowercase bucket name, only use by the hub
+	watching      map[string]*tWatched        // objects watched by $id, only use by the hub
+	listening     map[string]bool             // presence events received by lowercase bucket name, only use by the hub
+	present       string                      // user counted in the presence, only use by the hub
+	username      string
+	password      string
+	user          atomic.Value // username read by the hub to check the rights of the broadcasts
+	LoginAttempts []uint64     // contain the time when login attempt was made.
+
+	limiter map[string]*tTokenBucket // token buckets by class of action, only use by read
+
+	sent     uint64 // messages sent, access with atomic
+	dropped  uint64 // broadcasts dropped because send was full, access with atomic
+	resyncs  uint64 // resync messages sent, access with atomic
+	overflow int32  // broadcasts dropped since the last resync message, access with atomic
+	closing  bool   // the hub closed the websocket, only use by the hub
+}
+
+/* loggedUser return the username logged on the websocket, safe to call from the hub. */
+func (c *Client) loggedUser() string {
+	username, _ := c.user.Load().(string)
+	return username
+}
+
+/* canRead verify if the user logged on the websocket can still read a bucket,
+the rights may have changed since the client registered. Use by the hub, the
+right was verified by the client when it registered.
+*/
+func (c *Client) canRead(bucketname string) bool {
+	return knownUserRight(c.loggedUser(), bucketname+"-read")
+}
+
+/* rememberRead verify the read right of a bucket outside of the hub, so the
+hub know it when it call canRead.
+*/
+func (c *Client) rememberRead(bucketname string) {
+	CachedUserHasRight(c.loggedUser(), bucketname+"-read")
+}
+
+/* rememberRegistrations verify the read right of the buckets registered, the
+objects watched and the presence events, i.e. after a login.
+*/
+func (c *Client) rememberRegistrations() {
+
+	snap := &tSnapshot{client: c, buckets: map[string][]*tRegistration{}, watching: map[string]string{}, done: make(chan struct{})}
+	hub.snapshot <- snap
+	<-snap.done
+
+	for name := range snap.buckets {
+		c.rememberRead(name)
+	}
+	for _, name := range snap.watching {
+		c.rememberRead(name)
+	}
+	for _, name := range snap.listening {
+		c.rememberRead(presenceRight(name))
+	}
 }
 
 /*ClearLoginAttempt remove the login attempt that are older than 1 minutes and return
@@ -241,8 +691,16 @@ func (c *Client) ClearLoginAttempt() int {
 /*write Hub broadcasts a new message and this fires
  */
 func (c *Client) write() {
+
+	writeTimeout := configDuration(Configuration.WriteTimeout, defaultWriteTimeout)
+
+	// ping the client so a half-open connection is detected by read
+	ticker := time.NewTicker(configDuration(Configuration.PingInterval, defaultPingInterval))
+
 	// make sure to close the connection incase the loop exits
 	defer func() {
+		ticker.Stop()
+		close(c.done)
 		c.ws.Close()
 	}()
 
@@ -254,8 +712,7 @@ func (c *Client) write() {
 
 				logger.Trace("channel send error closed: " + string(message))
 
-				//c.ws.WriteMessage(websocket.CloseMessage, []byte{})
-				//Data        json.RawMessage `json:"data"`       // contain the JSON serialized object to be saved, it will be HTML Sanitized
+				c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
 
 				return
 
@@ -264,8 +721,30 @@ func (c *Client) write() {
 				logger.Trace(string(message))
 
 				if message != nil && len(message) > 0 {
-					c.ws.WriteMessage(websocket.TextMessage, message)
+					c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+					if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+						logger.Warn("client.write websocket error: " + err.Error())
+						return
+					}
+					atomic.AddUint64(&c.sent, 1)
 				}
+
+				// broadcasts were dropped, tell the client to reload its data
+				if atomic.SwapInt32(&c.overflow, 0) > 0 {
+					c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+					if err := c.ws.WriteMessage(websocket.TextMessage, resyncMessage); err != nil {
+						logger.Warn("client.write websocket error: " + err.Error())
+						return
+					}
+					atomic.AddUint64(&c.resyncs, 1)
+				}
+			}
+
+		case <-ticker.C:
+
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				logger.Warn("client.write websocket ping error: " + err.Error())
+				return
 			}
 
 		}
@@ -280,6 +759,21 @@ func (c *Client) read() {
 		c.ws.Close()
 	}()
 
+	// a client that does not answer the pings or send a message in time is
+	// closed, a message larger than the limit close the connection with 1009
+	pongTimeout := configDuration(Configuration.PongTimeout, defaultPongTimeout)
+
+	maxMessageSize := Configuration.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+
+	c.ws.SetReadLimit(maxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
 	for {
 
 		Msgtype, message, err := c.ws.ReadMessage()
@@ -293,6 +787,8 @@ func (c *Client) read() {
 
 		}
 
+		c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+
 		/*
 		   Packet of information are sent using msgClientCmd serializaed JSON
 		*/
@@ -313,215 +809,25 @@ func (c *Client) read() {
 			// command sent is not a valid JSON send a warning to the user.
 			// do not log returned error, because the error is cause by the frontend not the backend
 			// c.ws.WriteMessage(websocket.TextMessage, PrepMessageForUser("JSON OBJECT provided was invalid: "+SanitizeStrHTML(err.Error())))
-			c.send <- PrepMessageForUser("JSON OBJECT provided was invalid: " + SanitizeStrHTML(err.Error()))
+			if !c.reply(PrepMessageForUser("JSON OBJECT provided was invalid: " + SanitizeStrHTML(err.Error()))) {
+				break
+			}
 
 		} else {
 
 			// Here we have a valid JSON object check if we can do something with it!
 
-			var err error
-			var user []byte
-
-			// first check if user defer execution of this command
-
-			if packet.Action == "LOGIN" {
-
-				c.LoginAttempts = append(c.LoginAttempts, uint64(time.Now().UTC().Unix()))
-
-				count := c.ClearLoginAttempt()
-				if count > Configuration.LoginPerMin {
-					user = PrepMessageForUser("You have exceeded the maximum number of login attempt, try again in 1 min!")
-				} else {
-
-					user, err = DBLogin(&packet)
-
-					if err == nil {
-						// store crendential for the duration of the websocket connection
-						c.password = packet.Password
-						c.username = packet.Username
-						logger.Info("User " + c.username + " as logged in on this websocket!")
-					}
-					// if credential are already loaded they are not lost by doing a bad request!
-
-				}
-
-			} else if packet.Action == "LOGOUT" {
-
-				c.password = ""
-				c.username = ""
-				err = nil
-				user = []byte("{ \"action\":\"logout\"}")
-
-			} else if packet.Action == "QUERY" || packet.Action == "READALL" || packet.Action == "READONE" || packet.Action == "READFIND" || packet.Action == "READRANGE" {
-
-				/*
-				   Request range of information from a bucket should contain:
-				   bucketname, startdate, enddate, username and password
-
-				   Username and password is optional depending on the type of information requested!
-
-				   if startdate and enddate is null default range will be selected for some item such as open Bulletin the default range is
-				   all items in the Bucket!
-				*/
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-
-				user, err = DBRead(&packet)
-
-			} else if packet.Action == "LOGS" {
-
-				/*
-				   Request range of information from a bucket should contain:
-				   bucketname, startdate, enddate, username and password
-
-				   Username and password is optional depending on the type of information requested!
-
-				   if startdate and enddate is null default range will be selected for some item such as open Bulletin the default range is
-				   all items in the Bucket!
-				*/
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-
-				user, err = DBGetLogs(&packet)
-
-			} else if packet.Action == "UPDATE" {
-
-				/*
-				   Request Update information in the database  should contain:
-				   bucketname, username and password
-				   if key is not present or empty this is an insert else it is an update.
-
-				   if the update is valid a broadcast will be sent
-
-				*/
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = DBUpdate(&packet, false)
-
-			} else if packet.Action == "SETUSERSETTING" {
-
-				/*
-				   Request to Update a single property of a specific item.
-				   itemID is in key
-				   json object in data
-
-				*/
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = DBUserSettings(&packet)
-
-			} else if packet.Action == "INSERT" {
-
-				/*
-				   Request Update information in the database  should contain:
-				   bucketname, username and password
-				   if key is not present or empty this is an insert else it is an update.
-
-				   if the update is valid a broadcast will be sent
-
-				*/
+			// execute the command with the handler registered for the action
+			user, err := c.dispatch(&packet)
 
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = DBInsert(&packet, false)
-
-			} else if packet.Action == "REGISTEREVENT" {
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = registerEvent(c, &packet)
-
-			} else if packet.Action == "UNREGISTEREVENT" {
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = unregisterEvent(c, &packet)
-
-			} else if packet.Action == "GETTIME" {
-
-				user = GetTime()
-
-			} else if packet.Action == "GETCONFIG" {
-
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = GetConfiguration(&packet)
-
-			} else if packet.Action == "GETUSERS" {
-
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = GetUsers(&packet)
-
-			} else if packet.Action == "PUTCONFIG" {
-
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = PutConfiguration(&packet)
-
-			} else if packet.Action == "INDEXDROP" {
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = DBDropIndex(&packet)
-
-			} else if packet.Action == "INDEXCREATE" {
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = DBCreateIndex(&packet)
-
-			} else if packet.Action == "INDEXLIST" {
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = DBListIndex(&packet)
-
-			} else if packet.Action == "EMAILALERT" {
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = ReceiveEmailAlertChangeReq(&packet)
-
-			} else if packet.Action == "DELETE" {
-
-				/*
-				   Request to delete an item from the database should contain:
-				   bucketname, key, username and password
-
-				   if the delete is valid a broadcast will be sent
-
-				*/
-
-				// overwrite any provided credential with the proper credential
-				packet.Username = c.username
-				packet.Password = c.password
-				user, err = DBDelete(&packet, false)
-
-			} else {
-
-				/*
-				   Received Invalid command just ignore it....
-				*/
-
-				user = nil
-				err = nil
+			/*
+			   When the client provide a requestid every command it send must
+			   receive a reply that echo the requestid, even when the command
+			   does not normally reply (success of a write or defered command).
+			*/
 
+			if packet.RequestID != "" {
+				user = requestReply(user, err, packet.RequestID)
 			}
 
 			/*
@@ -531,21 +837,55 @@ func (c *Client) read() {
 
 			*/
 
-			if user != nil {
-				logger.Trace("Sending: " + string(user))
-				c.send <- user
-			}
-
 			if err != nil {
 				logger.Error(err.Error())
 			}
 
+			if user != nil {
+				logger.Trace("Sending: " + string(user))
+				if !c.reply(user) {
+					break
+				}
+			}
+
 		}
 
 	} // infinite for loop
 
 }
 
+/* requestReply return the reply to a command sent with a requestid, an ack when
+the command has no reply and a message when the reply is not a JSON object, so
+the requestid can always be added.
+*/
+func requestReply(user []byte, err error, requestid string) []byte {
+
+	switch trimmed := bytes.TrimSpace(user); {
+	case user == nil && err != nil:
+		user = PrepMessageForUser(err.Error())
+	case user == nil:
+		user = []byte("{\"action\":\"ack\"}")
+	case !json.Valid(trimmed) || trimmed[0] != '{':
+		user = PrepMessageForUser(string(user))
+	}
+
+	return SetRequestID(user, requestid)
+}
+
+/* reply queue a reply for the client, it wait for room in the queue unless
+write has exited. Return false when the connection is closed, i.e. the
+SlowClientDisconnect policy closed it.
+*/
+func (c *Client) reply(message []byte) bool {
+	select {
+	case c.send <- message:
+		return true
+	case <-c.done:
+		logger.Warn("Client " + c.username + " is closed, reply dropped")
+		return false
+	}
+}
+
 /*GetTime return the time on the server
  */
 func GetTime() []byte {
@@ -556,10 +896,43 @@ func GetTime() []byte {
 
 }
 
+/*subscribe ask the hub to add or remove the client from the clients registered
+to a bucket and wait until it is done, the broadcasts that follow the reply
+are sent according to the new registration.
+*/
+func (c *Client) subscribe(bucketname string, register bool, filter *tRegistration) {
+	sub := &tSubscription{client: c, bucketname: bucketname, register: register, filter: filter, done: make(chan struct{})}
+	hub.subscribe <- sub
+	<-sub.done
+}
+
+/*parseFilter return the registration for the conditions provided in packet.Data,
+the conditions use the same format than QUERY.
+*/
+func parseFilter(packet *MsgClientCmd) (*tRegistration, error) {
+
+	if len(packet.Data) == 0 || string(packet.Data) == "null" {
+		return &tRegistration{}, nil
+	}
+
+	filter, err := parseQuery(packet.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tRegistration{key: string(key), filter: filter}, nil
+}
+
 /*registerEvent request to be sent all event that occur in a specific bucket,
 i.e. update, insert, delete
 This function does not care if event is already register it simply add one
-item in the list.
+item in the list. Data can contain conditions, then only the changes where the
+new or the previous version of the object match are sent.
 */
 func registerEvent(c *Client, packet *MsgClientCmd) ([]byte, error) {
 
@@ -577,9 +950,15 @@ func registerEvent(c *Client, packet *MsgClientCmd) ([]byte, error) {
 		return []byte("{\"action\": \"registerevent\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"status\":false, \"error\":\"access denied\" }"), nil
 	}
 
+	filter, err := parseFilter(packet)
+	if err != nil {
+		return []byte("{\"action\": \"registerevent\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"status\":false, \"error\":\"Invalid filter: " + EscDoubleQuote(err.Error()) + "\" }"), nil
+	}
+
 	logger.Trace("Registering Event for " + packet.Bucketname + " from " + packet.Username)
 
-	c.registerEvents = append(c.registerEvents, packet.Bucketname)
+	c.rememberRead(packet.Bucketname)
+	c.subscribe(packet.Bucketname, true, filter)
 
 	return []byte("{\"action\": \"registerevent\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"status\":true}"), nil
 }
@@ -604,11 +983,129 @@ func unregisterEvent(c *Client, packet *MsgClientCmd) ([]byte, error) {
 
 	logger.Trace("Unregistering Event for " + packet.Bucketname + " for " + packet.Username)
 
-	for i := 0; i < len(c.registerEvents); i++ {
-		if c.registerEvents[i] == packet.Bucketname {
-			c.registerEvents = append(c.registerEvents[:i], c.registerEvents[i+1:]...)
-			break
-		}
+	filter, err := parseFilter(packet)
+	if err != nil {
+		return []byte("{\"action\": \"unregisterevent\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"status\":false, \"error\":\"Invalid filter: " + EscDoubleQuote(err.Error()) + "\" }"), nil
 	}
+
+	c.subscribe(packet.Bucketname, false, filter)
+
 	return []byte("{\"action\": \"unregisterevent\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"status\":true}"), nil
 }
+
+/*watchEvent request to be sent the changes made to specific objects of a bucket,
+the $id is in Key or many $id can be provided in Data as an array. UNWATCH stop
+sending the changes of the objects.
+*/
+func watchEvent(c *Client, packet *MsgClientCmd) ([]byte, error) {
+
+	action := strings.ToLower(packet.Action)
+
+	logger.Trace("Req " + action + " for " + packet.Bucketname + " from " + packet.Username)
+
+	reply := func(status bool, ids []string, e string) []byte {
+		list, _ := json.Marshal(ids)
+		if status {
+			return []byte("{\"action\": \"" + action + "\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"ids\":" + string(list) + ", \"status\":true}")
+		}
+		return []byte("{\"action\": \"" + action + "\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"ids\":" + string(list) + ", \"status\":false, \"error\":\"" + EscDoubleQuote(e) + "\" }")
+	}
+
+	ids := []string{}
+	if packet.Key != "" {
+		ids = append(ids, packet.Key)
+	} else if len(packet.Data) > 0 {
+		if err := json.Unmarshal(packet.Data, &ids); err != nil {
+			return reply(false, nil, "data must be an array of $id"), nil
+		}
+	}
+	if len(ids) == 0 {
+		return reply(false, nil, "no $id provided"), nil
+	}
+
+	// Check if the user has rights
+	access, err := UserHasRight([]byte(packet.Username), []byte(packet.Password), packet.Bucketname+"-read")
+	if err != nil {
+		logger.Error(action + " " + packet.Username + "  for " + packet.Bucketname + " error: " + err.Error())
+		return reply(false, ids, err.Error()), nil
+	}
+
+	if access == false {
+		logger.Warn("Access denied: User " + packet.Username + " " + action + " for " + packet.Bucketname)
+		return reply(false, ids, "access denied"), nil
+	}
+
+	c.rememberRead(packet.Bucketname)
+
+	w := &tWatch{client: c, bucketname: packet.Bucketname, ids: ids, register: packet.Action == "WATCH", done: make(chan struct{})}
+	hub.watch <- w
+	<-w.done
+
+	return reply(true, ids, ""), nil
+}
+
+/*resumeEvents replay the changes made after the sequence in Key to the buckets
+registered and the objects watched by the client, the sequence is the $seq of
+the last broadcast received. When the changes are no longer in the logs the
+client is told to do a full resync.
+*/
+func resumeEvents(c *Client, packet *MsgClientCmd) ([]byte, error) {
+
+	logger.Trace("Req resume after " + packet.Key + " from " + packet.Username)
+
+	after, err := strconv.ParseUint(packet.Key, 10, 64)
+	if err != nil {
+		return []byte("{\"action\": \"resume\", \"status\":false, \"resync\":false, \"error\":\"Invalid sequence " + EscDoubleQuote(packet.Key) + "\" }"), nil
+	}
+
+	snap := &tSnapshot{client: c, buckets: map[string][]*tRegistration{}, watching: map[string]string{}, done: make(chan struct{})}
+	hub.snapshot <- snap
+	<-snap.done
+
+	buckets := []string{}
+	for name := range snap.buckets {
+		buckets = append(buckets, name)
+	}
+	for _, name := range snap.watching {
+		buckets = append(buckets, name)
+	}
+
+	changes, resync, err := dbChangesAfter(after, buckets, Configuration.MaxReadItemsFromDB)
+	if err != nil {
+		logger.Error("resume for " + packet.Username + " error: " + err.Error())
+		return []byte("{\"action\": \"resume\", \"status\":false, \"resync\":false, \"error\":\"" + EscDoubleQuote(err.Error()) + "\" }"), nil
+	}
+
+	if resync {
+		logger.Info("resume for " + packet.Username + " after " + packet.Key + " is outside the logs, full resync needed")
+		return []byte("{\"action\": \"resume\", \"status\":false, \"resync\":true, \"error\":\"full resync needed\" }"), nil
+	}
+
+	seq := after
+	items := [][]byte{}
+	for _, change := range changes {
+
+		seq = change.seq
+
+		name := strings.ToLower(change.bucketname)
+		parsed := &tParsedBroadcast{broadcast: &TBroadcast{Bucketname: change.bucketname, ID: change.id, Message: change.message, Previous: change.previous}}
+
+		registered := len(snap.buckets[name]) > 0 && parsed.accept(snap.buckets[name])
+		if !registered && snap.watching[change.id] != name {
+			continue
+		}
+		if !CachedUserHasRight(packet.Username, change.bucketname+"-read") {
+			continue
+		}
+		if message := Redact(change.bucketname, change.message); message != nil {
+			items = append(items, message)
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteString("{\"action\": \"resume\", \"status\":true, \"seq\":" + strconv.FormatUint(seq, 10) + ", \"items\":[")
+	buffer.Write(bytes.Join(items, []byte(",")))
+	buffer.WriteString("]}")
+
+	return buffer.Bytes(), nil
+}
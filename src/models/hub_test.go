@@ -0,0 +1,166 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/gorilla/websocket"
+)
+
+var startHub sync.Once
+
+/* dialHub start the hub and return a websocket connected to a client of the hub. */
+func dialHub(t *testing.T) *websocket.Conn {
+
+	startHub.Do(HubStart)
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			ClientAdd(conn)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestRequestReply(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		reply   []byte
+		err     error
+		action  string
+		message string
+	}{
+		{"reply", []byte(`{"action":"read", "items":[]}`), nil, "read", ""},
+		{"no reply", nil, nil, "ack", ""},
+		{"error", nil, errors.New("Access denied"), "message", "Access denied"},
+		{"reply and error", []byte(`{"action":"message", "message":"refused"}`), errors.New("logged"), "message", "refused"},
+		{"not json", []byte("User saved!"), nil, "message", "User saved!"},
+		{"not an object", []byte(`["a"]`), nil, "message", `["a"]`},
+		{"invalid json", []byte(`{"action":`), nil, "message", `{"action":`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply := requestReply(test.reply, test.err, "42")
+			parsed, err := gabs.ParseJSON(reply)
+			if err != nil {
+				t.Fatal(string(reply))
+			}
+			if parsed.Path("requestid").Data() != "42" || parsed.Path("action").Data() != test.action {
+				t.Fatal(string(reply))
+			}
+			if test.message != "" && parsed.Path("message").Data() != test.message {
+				t.Fatal(string(reply))
+			}
+		})
+	}
+}
+
+func TestReadRequestID(t *testing.T) {
+
+	RegisterAction("TESTNOREPLY", func(c *Client, packet *MsgClientCmd) ([]byte, error) {
+		return nil, nil
+	}, "", "")
+	RegisterAction("TESTTEXT", func(c *Client, packet *MsgClientCmd) ([]byte, error) {
+		return []byte("done"), nil
+	}, "", "")
+	defer func() {
+		actions.Lock()
+		delete(actions.registered, "TESTNOREPLY")
+		delete(actions.registered, "TESTTEXT")
+		actions.Unlock()
+	}()
+
+	conn := dialHub(t)
+
+	read := func() *gabs.Container {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := gabs.ParseJSON(message)
+		if err != nil {
+			t.Fatal(string(message))
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name      string
+		command   string
+		requestid string
+		action    string
+	}{
+		{"no reply", `{"action":"TESTNOREPLY", "requestid":"1"}`, "1", "ack"},
+		{"text reply", `{"action":"TESTTEXT", "requestid":"2"}`, "2", "message"},
+		{"unknown action", `{"action":"TESTUNKNOWN", "requestid":"3"}`, "3", "message"},
+	}
+
+	for _, test := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(test.command)); err != nil {
+			t.Fatal(err)
+		}
+		if reply := read(); reply.Path("requestid").Data() != test.requestid || reply.Path("action").Data() != test.action {
+			t.Fatal(test.name, reply.String())
+		}
+	}
+
+	// without requestid a command without reply receive nothing
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"TESTNOREPLY"}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"TESTTEXT", "requestid":"4"}`))
+	if reply := read(); reply.Path("requestid").Data() != "4" {
+		t.Fatal(reply.String())
+	}
+
+	// a command that is not JSON can't be matched with a requestid
+	conn.WriteMessage(websocket.TextMessage, []byte(`not json`))
+	if reply := read(); reply.Path("action").Data() != "message" || reply.Exists("requestid") {
+		t.Fatal(reply.String())
+	}
+}
+
+func TestStatsAction(t *testing.T) {
+
+	if action := actions.registered["STATS"]; action == nil || action.RequiredRight != "stats-read" {
+		t.Fatal("STATS require the stats-read right")
+	}
+
+	// once it replied the client is in the hub
+	conn := dialHub(t)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"TESTUNKNOWN"}`))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := statsAction(nil, &MsgClientCmd{Action: "STATS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := gabs.ParseJSON(reply)
+	if err != nil {
+		t.Fatal(string(reply))
+	}
+
+	clients, _ := parsed.Path("server.clients").Children()
+	if parsed.Path("action").Data() != "stats" || len(clients) == 0 || !clients[0].Exists("capacity") {
+		t.Fatal(string(reply))
+	}
+}
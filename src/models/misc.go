@@ -40,6 +40,7 @@ ______________________________________________________________________________
 package models
 
 import (
+	"bytes"
 	"math/rand"
 	"os"
 	"strings"
@@ -62,6 +63,36 @@ func PrepMessageForUser(msg string) []byte {
 
 }
 
+/*PrepStatusForUser prepare the reply to a command that succeeded, the client
+check the status and the message can be display to the user.
+*/
+func PrepStatusForUser(action, msg string) []byte {
+	return []byte("{ \"action\":\"" + action + "\", \"status\":true, \"message\":\"" + EscDoubleQuote(msg) + "\"}")
+}
+
+/*SetRequestID add the requestid of the command to a message that is returned to the
+FRONT-END so the client can match the reply with the command it sent.
+*/
+func SetRequestID(msg []byte, requestid string) []byte {
+
+	i := bytes.IndexByte(msg, '{')
+	if i < 0 {
+		return msg
+	}
+
+	field := "\"requestid\":\"" + EscDoubleQuote(requestid) + "\""
+
+	// do not add a comma if the object is empty
+	if len(bytes.TrimSpace(msg[i+1:])) > 0 && bytes.TrimSpace(msg[i+1:])[0] != '}' {
+		field += ","
+	}
+
+	result := make([]byte, 0, len(msg)+len(field))
+	result = append(result, msg[:i+1]...)
+	result = append(result, field...)
+	return append(result, msg[i+1:]...)
+}
+
 /*UnixUTCSecs return the number of seconds since 1970
  */
 func UnixUTCSecs() float64 {
@@ -0,0 +1,43 @@
+package models
+
+import "testing"
+
+func TestSetRequestID(t *testing.T) {
+
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"object", `{"action":"read"}`, `{"requestid":"7","action":"read"}`},
+		{"spaces", `{ "action":"message"}`, `{"requestid":"7", "action":"message"}`},
+		{"empty object", `{}`, `{"requestid":"7"}`},
+		{"empty object with spaces", `{ }`, `{"requestid":"7" }`},
+		{"not json", `User saved!`, `User saved!`},
+		{"empty", ``, ``},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(SetRequestID([]byte(test.msg), "7")); got != test.want {
+				t.Fatal(got)
+			}
+		})
+	}
+
+	// the requestid is escaped
+	if got := string(SetRequestID([]byte(`{}`), `a"b`)); got != `{"requestid":"a\"b"}` {
+		t.Fatal(got)
+	}
+
+	// nil stay nil, the caller decide what to send
+	if got := SetRequestID(nil, "7"); got != nil {
+		t.Fatal(string(got))
+	}
+}
+
+func TestPrepStatusForUser(t *testing.T) {
+	if got := string(SetRequestID(PrepStatusForUser("indexdrop", `Index "a" dropped`), "7")); got != `{"requestid":"7", "action":"indexdrop", "status":true, "message":"Index \"a\" dropped"}` {
+		t.Fatal(got)
+	}
+}
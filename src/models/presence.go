@@ -0,0 +1,331 @@
+/*
+______________________________________________________________________________
+
+ Ecureuil - Web framework for real-time javascript app.
+_____________________________________________________________________________
+
+MIT License
+
+Copyright (c) 2014-2016 Marc Gauthier
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+______________________________________________________________________________
+
+
+This file contain the presence, the users logged on a websocket and the
+users registered to each bucket. PRESENCE return the users registered to a
+bucket, or the users online without bucketname. With the key "on" the client
+also receive an event when a user register to the bucket or unregister from
+it, or when a user join or leave without bucketname. The key "off" stop the
+events.
+
+	{"action":"presence", "event":"subscribe", "bucketname":"INCIDENTS", "username":"marc"}
+
+A user with many websockets is present until the last one is closed, the
+anonymous users are not listed. The users online are listed to the users with
+the PRESENCE-read right, the users of a bucket to those that can read it.
+
+______________________________________________________________________________
+
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/antigloss/go/logger"
+)
+
+/*PresenceBUCKET the users with the PRESENCE-read right can list the users online.
+ */
+var PresenceBUCKET = []byte("PRESENCE")
+
+/* presence events sent to the clients listening */
+const (
+	presenceJoin        = "join"
+	presenceLeave       = "leave"
+	presenceSubscribe   = "subscribe"
+	presenceUnsubscribe = "unsubscribe"
+)
+
+/*tPresent users registered to a bucket, a user is counted once per websocket
+registered. Bucketname is the name of the first registration, use to check
+the rights of the clients listening.
+*/
+type tPresent struct {
+	bucketname string
+	users      map[string]int
+}
+
+/*tPresence request to list the users present in a bucket, or online when
+bucketname is empty. Listen start or stop the events when it is "on" or
+"off". done is closed once the hub has filled users.
+*/
+type tPresence struct {
+	client     *Client
+	bucketname string
+	listen     string
+	users      []string
+	done       chan struct{}
+}
+
+/*identify tell the hub the user logged on the websocket changed, the
+presence of the previous user is removed.
+*/
+func (c *Client) identify() {
+	hub.identify <- c
+}
+
+/*rename move the presence of a client to the user now logged on its
+websocket, the new user enter the buckets before the previous one exit them
+so the bucketname of the registrations is kept.
+*/
+func (hub *Hub) rename(conn *Client) {
+
+	username := conn.loggedUser()
+	previous := conn.present
+	if username == previous {
+		return
+	}
+
+	conn.present = username
+	hub.goOnline(username)
+	for name := range conn.buckets {
+		hub.enter(username, name, "")
+	}
+
+	for name := range conn.buckets {
+		hub.exit(previous, name)
+	}
+	hub.goOffline(previous)
+}
+
+/*absent remove the presence of a client that is closed.
+ */
+func (hub *Hub) absent(conn *Client) {
+	for name := range conn.buckets {
+		hub.exit(conn.present, name)
+	}
+	hub.goOffline(conn.present)
+}
+
+/* goOnline count a websocket of a user, join is sent for the first one. */
+func (hub *Hub) goOnline(username string) {
+	if username == "" {
+		return
+	}
+	hub.online[username]++
+	if hub.online[username] == 1 {
+		hub.notifyPresence("", presenceJoin, username)
+	}
+}
+
+/* goOffline remove a websocket of a user, leave is sent for the last one. */
+func (hub *Hub) goOffline(username string) {
+	if username == "" || hub.online[username] == 0 {
+		return
+	}
+	hub.online[username]--
+	if hub.online[username] == 0 {
+		delete(hub.online, username)
+		hub.notifyPresence("", presenceLeave, username)
+	}
+}
+
+/*enter count a websocket of a user registered to a bucket, subscribe is sent
+for the first one. The anonymous users are counted so the bucketname is known
+when they login.
+*/
+func (hub *Hub) enter(username, name, bucketname string) {
+
+	p := hub.present[name]
+	if p == nil {
+		if bucketname == "" {
+			bucketname = name
+		}
+		p = &tPresent{bucketname: bucketname, users: make(map[string]int)}
+		hub.present[name] = p
+	}
+
+	p.users[username]++
+	if p.users[username] == 1 && username != "" {
+		hub.notifyPresence(name, presenceSubscribe, username)
+	}
+}
+
+/*exit remove a websocket of a user registered to a bucket, unsubscribe is
+sent for the last one.
+*/
+func (hub *Hub) exit(username, name string) {
+
+	p := hub.present[name]
+	if p == nil || p.users[username] == 0 {
+		return
+	}
+
+	p.users[username]--
+	if p.users[username] > 0 {
+		return
+	}
+
+	delete(p.users, username)
+	if username != "" {
+		hub.notifyPresence(name, presenceUnsubscribe, username)
+	}
+	if len(p.users) == 0 {
+		delete(hub.present, name)
+	}
+}
+
+/* presenceRight return the bucket whose read right is needed for the
+presence of a bucket, PRESENCE without bucketname.
+*/
+func presenceRight(bucketname string) string {
+	if bucketname == "" {
+		return string(PresenceBUCKET)
+	}
+	return bucketname
+}
+
+/*notifyPresence send a presence event to the clients listening to the bucket
+that can still read it, join and leave are sent to the clients listening
+without bucketname that have the PRESENCE-read right.
+*/
+func (hub *Hub) notifyPresence(name, event, username string) {
+
+	listeners := hub.listeners[name]
+	if len(listeners) == 0 {
+		return
+	}
+
+	if name == "" {
+		msg := []byte("{\"action\":\"presence\", \"event\":\"" + event + "\", \"username\":\"" + EscDoubleQuote(username) + "\"}")
+		for conn := range listeners {
+			if conn.loggedUser() != "" && conn.canRead(string(PresenceBUCKET)) {
+				hub.deliver(conn, msg)
+			}
+		}
+		return
+	}
+
+	bucketname := hub.present[name].bucketname
+	msg := []byte("{\"action\":\"presence\", \"event\":\"" + event + "\", \"bucketname\":\"" + EscDoubleQuote(bucketname) + "\", \"username\":\"" + EscDoubleQuote(username) + "\"}")
+	for conn := range listeners {
+		if conn.canRead(bucketname) {
+			hub.deliver(conn, msg)
+		}
+	}
+}
+
+/*updatePresence start or stop the events of a client and list the users
+present.
+*/
+func (hub *Hub) updatePresence(p *tPresence) {
+
+	name := strings.ToLower(p.bucketname)
+	conn := p.client
+
+	switch p.listen {
+	case "on":
+		if hub.listeners[name] == nil {
+			hub.listeners[name] = make(map[*Client]bool)
+		}
+		hub.listeners[name][conn] = true
+		conn.listening[name] = true
+	case "off":
+		hub.unlisten(conn, name)
+	}
+
+	users := hub.online
+	if name != "" {
+		users = nil
+		if present := hub.present[name]; present != nil {
+			users = present.users
+		}
+	}
+
+	p.users = make([]string, 0, len(users))
+	for username := range users {
+		if username != "" {
+			p.users = append(p.users, username)
+		}
+	}
+	sort.Strings(p.users)
+}
+
+/*unlisten stop the presence events of a bucket for a client.
+ */
+func (hub *Hub) unlisten(conn *Client, name string) {
+	delete(conn.listening, name)
+	delete(hub.listeners[name], conn)
+	if len(hub.listeners[name]) == 0 {
+		delete(hub.listeners, name)
+	}
+}
+
+/*presenceEvent return the users registered to a bucket, or the users online
+without bucketname. The key "on" or "off" start or stop the presence events.
+*/
+func presenceEvent(c *Client, packet *MsgClientCmd) ([]byte, error) {
+
+	logger.Trace("Req presence for " + packet.Bucketname + " from " + packet.Username)
+
+	reply := func(users []string, e string) []byte {
+		if e != "" {
+			return []byte("{\"action\":\"presence\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"status\":false, \"error\":\"" + EscDoubleQuote(e) + "\" }")
+		}
+		list, _ := json.Marshal(users)
+		return []byte("{\"action\":\"presence\", \"bucketname\":\"" + EscDoubleQuote(packet.Bucketname) + "\", \"users\":" + string(list) + ", \"status\":true}")
+	}
+
+	if packet.Key != "" && packet.Key != "on" && packet.Key != "off" {
+		return reply(nil, "key must be on, off or empty"), nil
+	}
+
+	// only the logged users with the right can see who is online
+	if packet.Bucketname == "" && packet.Username == "" {
+		logger.Warn("Access denied: anonymous user request presence")
+		return reply(nil, "access denied"), nil
+	}
+
+	right := presenceRight(packet.Bucketname)
+
+	access, err := UserHasRight([]byte(packet.Username), []byte(packet.Password), right+"-read")
+	if err != nil {
+		logger.Error("Presence " + packet.Username + " for " + right + " error: " + err.Error())
+		return reply(nil, err.Error()), nil
+	}
+
+	if access == false {
+		logger.Warn("Access denied: User " + packet.Username + " presence for " + right)
+		return reply(nil, "access denied"), nil
+	}
+
+	c.rememberRead(right)
+
+	p := &tPresence{client: c, bucketname: packet.Bucketname, listen: packet.Key, done: make(chan struct{})}
+	hub.presence <- p
+	<-p.done
+
+	return reply(p.users, ""), nil
+}
@@ -0,0 +1,237 @@
+/*
+______________________________________________________________________________
+
+ Ecureuil - Web framework for real-time javascript app.
+_____________________________________________________________________________
+
+MIT License
+
+Copyright (c) 2014-2016 Marc Gauthier
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+______________________________________________________________________________
+
+
+This file contain the token buckets that limit the number of commands a
+websocket connection, and all the connections of a user, can send for each
+class of action. LOGIN is limited separately by LoginPerMin.
+
+______________________________________________________________________________
+
+*/
+
+package models
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*TRateLimit token bucket, Rate commands per second are allowed with up to Burst
+commands at once. A Rate of 0 is unlimited.
+*/
+type TRateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+/*TRateLimits limits of each class of action.
+ */
+type TRateLimits struct {
+	Read  TRateLimit `json:"read"`
+	Write TRateLimit `json:"write"`
+	Admin TRateLimit `json:"admin"`
+}
+
+/* limits of a new configuration, or of a configuration saved without them */
+var (
+	defaultConnectionRateLimits = TRateLimits{
+		Read:  TRateLimit{Rate: 50, Burst: 100},
+		Write: TRateLimit{Rate: 20, Burst: 40},
+		Admin: TRateLimit{Rate: 1, Burst: 5},
+	}
+	defaultUserRateLimits = TRateLimits{
+		Read:  TRateLimit{Rate: 200, Burst: 400},
+		Write: TRateLimit{Rate: 50, Burst: 100},
+		Admin: TRateLimit{Rate: 2, Burst: 10},
+	}
+)
+
+/*Classes of action that are rate limited.
+ */
+const (
+	RateClassRead  = "read"
+	RateClassWrite = "write"
+	RateClassAdmin = "admin"
+)
+
+/* limit return the limit of a class of action. */
+func (l *TRateLimits) limit(class string) TRateLimit {
+	switch class {
+	case RateClassRead:
+		return l.Read
+	case RateClassWrite:
+		return l.Write
+	}
+	return l.Admin
+}
+
+/* validate return an error if a limit is negative. */
+func (l *TRateLimits) validate() error {
+	for _, limit := range []TRateLimit{l.Read, l.Write, l.Admin} {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return errors.New("Rate limits can't be negative")
+		}
+	}
+	return nil
+}
+
+/* tTokenBucket hold the tokens left at time last. */
+type tTokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/* burst return the size of the bucket, at least one command. */
+func (limit TRateLimit) burst() float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
+
+/* wait refill the bucket and return how long until a token is available, 0 if
+one is available now.
+*/
+func (b *tTokenBucket) wait(limit TRateLimit, now time.Time) time.Duration {
+
+	if b.last.IsZero() {
+		b.tokens = limit.burst()
+	} else {
+		b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+/* full return true if the bucket is refilled at time now, it can be forgotten. */
+func (b *tTokenBucket) full(limit TRateLimit, now time.Time) bool {
+	return limit.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst()
+}
+
+/* userLimiters token buckets shared by the connections of a user, by username
+and class of action.
+*/
+var userLimiters = struct {
+	sync.Mutex
+	buckets map[string]map[string]*tTokenBucket
+	pruned  time.Time
+}{buckets: make(map[string]map[string]*tTokenBucket)}
+
+/* rateLimited take a token for a class of action from the bucket of the
+connection and of the user, when one is empty it return how long the client
+must wait. An action without class is not limited. Only use by the read
+function of the client.
+*/
+func (c *Client) rateLimited(class string) time.Duration {
+
+	if class == "" {
+		return 0
+	}
+
+	now := time.Now()
+	connLimit := Configuration.ConnectionRateLimits.limit(class)
+	userLimit := Configuration.UserRateLimits.limit(class)
+
+	var retry time.Duration
+
+	var conn *tTokenBucket
+	if connLimit.Rate > 0 {
+		if conn = c.limiter[class]; conn == nil {
+			conn = &tTokenBucket{}
+			c.limiter[class] = conn
+		}
+		retry = conn.wait(connLimit, now)
+	}
+
+	userLimiters.Lock()
+	defer userLimiters.Unlock()
+
+	// forget the buckets that are refilled so the map does not grow forever
+	if now.Sub(userLimiters.pruned) > time.Minute {
+		for username, buckets := range userLimiters.buckets {
+			for name, b := range buckets {
+				if b.full(Configuration.UserRateLimits.limit(name), now) {
+					delete(buckets, name)
+				}
+			}
+			if len(buckets) == 0 {
+				delete(userLimiters.buckets, username)
+			}
+		}
+		userLimiters.pruned = now
+	}
+
+	var user *tTokenBucket
+	if userLimit.Rate > 0 && c.username != "" {
+		buckets := userLimiters.buckets[c.username]
+		if buckets == nil {
+			buckets = make(map[string]*tTokenBucket)
+			userLimiters.buckets[c.username] = buckets
+		}
+		if user = buckets[class]; user == nil {
+			user = &tTokenBucket{}
+			buckets[class] = user
+		}
+		if wait := user.wait(userLimit, now); wait > retry {
+			retry = wait
+		}
+	}
+
+	if retry > 0 {
+		return retry
+	}
+
+	if conn != nil {
+		conn.tokens--
+	}
+	if user != nil {
+		user.tokens--
+	}
+	return 0
+}
+
+/*rateLimitedMessage reply to a command refused because the client sent too many
+commands of its class, retryafter is in milliseconds.
+*/
+func rateLimitedMessage(action, class string, retry time.Duration) []byte {
+
+	ms := strconv.FormatInt(int64(math.Ceil(float64(retry)/float64(time.Millisecond))), 10)
+
+	return []byte("{\"action\":\"ratelimited\", \"command\":\"" + EscDoubleQuote(action) + "\", \"class\":\"" + class + "\", \"retryafter\":" + ms +
+		", \"message\":\"rate limited, retry after " + ms + " ms\"}")
+}
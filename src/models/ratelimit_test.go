@@ -0,0 +1,134 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jeffail/gabs"
+)
+
+/* take a token like rateLimited does, return how long to wait if none is left. */
+func take(b *tTokenBucket, limit TRateLimit, now time.Time) time.Duration {
+	wait := b.wait(limit, now)
+	if wait == 0 {
+		b.tokens--
+	}
+	return wait
+}
+
+func TestTokenBucket(t *testing.T) {
+
+	limit := TRateLimit{Rate: 4, Burst: 3}
+	now := time.Now()
+	b := &tTokenBucket{}
+
+	// a new bucket is full
+	for i := 0; i < 3; i++ {
+		if wait := take(b, limit, now); wait != 0 {
+			t.Fatal("burst", i, wait)
+		}
+	}
+
+	// empty, a token come back every 1/4 second
+	if wait := take(b, limit, now); wait != 250*time.Millisecond {
+		t.Fatal("retry after", wait)
+	}
+	if wait := take(b, limit, now.Add(100*time.Millisecond)); wait != 150*time.Millisecond {
+		t.Fatal("retry after", wait)
+	}
+	if wait := take(b, limit, now.Add(250*time.Millisecond)); wait != 0 {
+		t.Fatal("refill", wait)
+	}
+	if b.full(limit, now.Add(500*time.Millisecond)) {
+		t.Fatal("full too soon")
+	}
+
+	// the refill stop at the burst
+	now = now.Add(time.Hour)
+	if !b.full(limit, now) {
+		t.Fatal("not full")
+	}
+	for i := 0; i < 3; i++ {
+		if wait := take(b, limit, now); wait != 0 {
+			t.Fatal("burst after refill", i, wait)
+		}
+	}
+	if wait := take(b, limit, now); wait == 0 {
+		t.Fatal("more than the burst")
+	}
+
+	// a burst of 0 still allow one command
+	b = &tTokenBucket{}
+	if wait := take(b, TRateLimit{Rate: 1}, now); wait != 0 {
+		t.Fatal("no burst", wait)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+
+	connection, user := Configuration.ConnectionRateLimits, Configuration.UserRateLimits
+	defer func() {
+		Configuration.ConnectionRateLimits, Configuration.UserRateLimits = connection, user
+		userLimiters.buckets = make(map[string]map[string]*tTokenBucket)
+	}()
+
+	Configuration.ConnectionRateLimits = TRateLimits{Read: TRateLimit{Rate: 10, Burst: 2}}
+	Configuration.UserRateLimits = TRateLimits{Read: TRateLimit{Rate: 0.1, Burst: 3}}
+
+	newClient := func(username string) *Client {
+		return &Client{limiter: map[string]*tTokenBucket{}, username: username}
+	}
+	first, second, anonymous := newClient("bob"), newClient("bob"), newClient("")
+
+	// the limit of the connection is reached first
+	for i := 0; i < 2; i++ {
+		if wait := first.rateLimited(RateClassRead); wait != 0 {
+			t.Fatal(i, wait)
+		}
+	}
+	if wait := first.rateLimited(RateClassRead); wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatal("connection", wait)
+	}
+
+	// the connections of a user share the limit of the user
+	if wait := second.rateLimited(RateClassRead); wait != 0 {
+		t.Fatal(wait)
+	}
+	if wait := second.rateLimited(RateClassRead); wait < 9*time.Second {
+		t.Fatal("user", wait)
+	}
+
+	// a refused command does not take a token
+	if tokens := second.limiter[RateClassRead].tokens; tokens < 1 || tokens > 1.1 {
+		t.Fatal("tokens", tokens)
+	}
+
+	// a connection not logged in only has the limit of the connection
+	for i := 0; i < 2; i++ {
+		if wait := anonymous.rateLimited(RateClassRead); wait != 0 {
+			t.Fatal("anonymous", i, wait)
+		}
+	}
+
+	// a class without a rate and an action without class are not limited
+	if wait := second.rateLimited(RateClassWrite); wait != 0 {
+		t.Fatal("write", wait)
+	}
+	if wait := second.rateLimited(""); wait != 0 {
+		t.Fatal("no class", wait)
+	}
+}
+
+func TestRateLimitedMessage(t *testing.T) {
+
+	message := rateLimitedMessage("READ\"ALL", RateClassRead, 1500*time.Microsecond)
+	parsed, err := gabs.ParseJSON(message)
+	if err != nil {
+		t.Fatal(string(message))
+	}
+
+	// the retry is rounded up to the millisecond
+	if parsed.Path("command").Data() != "READ\"ALL" || parsed.Path("retryafter").Data() != float64(2) {
+		t.Fatal(string(message))
+	}
+}
@@ -0,0 +1,195 @@
+/*
+______________________________________________________________________________
+
+ Ecureuil - Web framework for real-time javascript app.
+_____________________________________________________________________________
+
+MIT License
+
+Copyright (c) 2014-2016 Marc Gauthier
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+______________________________________________________________________________
+
+
+This file contain the cache of the rights checked every time a broadcast is
+delivered to a client, and the properties removed from the objects sent to
+the clients by a read or a broadcast.
+
+______________________________________________________________________________
+
+*/
+
+package models
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Jeffail/gabs"
+	"github.com/antigloss/go/logger"
+)
+
+/*RedactedFields properties removed from the objects of a bucket before they are
+sent to a client, by a read or a broadcast. Bucket names are uppercase.
+*/
+var RedactedFields = map[string][]string{
+	"USERS": {"passwordhash", "newpassword"},
+}
+
+/*RightsBuckets a change to the objects of these buckets clear the rights cache.
+ */
+var RightsBuckets = []string{"USERS", "USERRIGHTS", "USERGROUPS"}
+
+/* tRightsCache result of VerifyUserHasRight by username and lowercase right
+name, names keep the right name use to verify it.
+*/
+type tRightsCache struct {
+	sync.RWMutex
+	rights     map[string]map[string]bool
+	names      map[string]string
+	generation uint64 // incremented when refreshed, a right verified before is not kept
+	refresh    sync.Mutex
+}
+
+var rightsCache = tRightsCache{rights: make(map[string]map[string]bool), names: make(map[string]string)}
+
+/* verifyRight verify a right in the database for the rights cache, the tests
+replace it.
+*/
+var verifyRight = VerifyUserHasRight
+
+/*Redact remove the redacted properties of an object of bucketname, data is
+returned unchanged if the bucket has none.
+*/
+func Redact(bucketname string, data []byte) []byte {
+
+	fields, ok := RedactedFields[strings.ToUpper(bucketname)]
+	if !ok {
+		return data
+	}
+
+	jsonParsed, err := gabs.ParseJSON(data)
+	if err != nil {
+		logger.Error("Unable to redact object of " + bucketname + " " + err.Error())
+		return nil
+	}
+
+	for _, field := range fields {
+		jsonParsed.Delete(field)
+	}
+
+	return jsonParsed.Bytes()
+}
+
+/*CachedUserHasRight verify if user has a right without checking the password,
+the result is kept and verified again by RefreshRightsCache. It query the
+database when the right is not known, the hub use knownUserRight instead.
+*/
+func CachedUserHasRight(username, rightname string) bool {
+
+	key := strings.ToLower(rightname)
+
+	rightsCache.RLock()
+	access, ok := rightsCache.rights[username][key]
+	generation := rightsCache.generation
+	rightsCache.RUnlock()
+
+	if ok {
+		return access
+	}
+
+	access = false
+	if username != "" {
+		access = verifyRight([]byte(username), rightname) == nil
+	}
+
+	rightsCache.Lock()
+	if rightsCache.generation == generation {
+		if rightsCache.rights[username] == nil {
+			rightsCache.rights[username] = make(map[string]bool)
+		}
+		rightsCache.rights[username][key] = access
+		rightsCache.names[key] = rightname
+	}
+	rightsCache.Unlock()
+
+	return access
+}
+
+/* knownUserRight return the right kept by CachedUserHasRight, a right that was
+never verified is denied. It never query the database so the hub is not
+stalled, the clients verify their rights when they register.
+*/
+func knownUserRight(username, rightname string) bool {
+	rightsCache.RLock()
+	defer rightsCache.RUnlock()
+	return rightsCache.rights[username][strings.ToLower(rightname)]
+}
+
+/*RefreshRightsCache verify again the rights kept by CachedUserHasRight, it is
+called when an object of one of the RightsBuckets change. The rights kept are
+use until they are all verified.
+*/
+func RefreshRightsCache() {
+
+	logger.Trace("Refreshing rights cache")
+
+	rightsCache.refresh.Lock()
+	defer rightsCache.refresh.Unlock()
+
+	rightsCache.Lock()
+	rightsCache.generation++
+	verify := make(map[string][]string, len(rightsCache.rights))
+	for username, rights := range rightsCache.rights {
+		for key := range rights {
+			verify[username] = append(verify[username], key)
+		}
+	}
+	names := make(map[string]string, len(rightsCache.names))
+	for key, name := range rightsCache.names {
+		names[key] = name
+	}
+	rightsCache.Unlock()
+
+	refreshed := make(map[string]map[string]bool, len(verify))
+	for username, keys := range verify {
+		refreshed[username] = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			refreshed[username][key] = username != "" && verifyRight([]byte(username), names[key]) == nil
+		}
+	}
+
+	// the rights verified during the refresh are already up to date
+	rightsCache.Lock()
+	for username, rights := range rightsCache.rights {
+		for key, access := range rights {
+			if _, ok := refreshed[username][key]; ok {
+				continue
+			}
+			if refreshed[username] == nil {
+				refreshed[username] = make(map[string]bool)
+			}
+			refreshed[username][key] = access
+		}
+	}
+	rightsCache.rights = refreshed
+	rightsCache.Unlock()
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+)
+
+/* newTestHub return a hub that is not started, the tests call its methods. */
+func newTestHub() *Hub {
+	return &Hub{clients: map[*Client]bool{}, buckets: map[string]map[*Client]bool{}, watchers: map[string]map[*Client]bool{},
+		online: map[string]int{}, present: map[string]*tPresent{}, listeners: map[string]map[*Client]bool{}}
+}
+
+/* newTestClient return a client of the hub logged as username, without websocket. */
+func newTestClient(h *Hub, username string) *Client {
+	c := &Client{send: make(chan []byte, 10), buckets: map[string][]*tRegistration{}, watching: map[string]*tWatched{}, listening: map[string]bool{}, username: username}
+	c.user.Store(username)
+	h.clients[c] = true
+	return c
+}
+
+/* received return the messages queued for a client. */
+func received(c *Client) []string {
+	messages := []string{}
+	for {
+		select {
+		case m := <-c.send:
+			messages = append(messages, string(m))
+		default:
+			return messages
+		}
+	}
+}
+
+/* stubRights replace the rights of the database for a test, the rights
+granted can be changed with the function returned.
+*/
+func stubRights(t *testing.T) func(username, rightname string, granted bool) {
+
+	var mu sync.Mutex
+	granted := map[string]bool{}
+
+	verify := verifyRight
+	verifyRight = func(username []byte, rightname string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if granted[string(username)+" "+strings.ToLower(rightname)] {
+			return nil
+		}
+		return errors.New("Access denied")
+	}
+	rightsCache.rights, rightsCache.names = map[string]map[string]bool{}, map[string]string{}
+
+	t.Cleanup(func() {
+		verifyRight = verify
+		rightsCache.rights, rightsCache.names = map[string]map[string]bool{}, map[string]string{}
+	})
+
+	return func(username, rightname string, access bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		granted[username+" "+strings.ToLower(rightname)] = access
+	}
+}
+
+func TestRedact(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		bucketname string
+		data       string
+		removed    []string
+		kept       []string
+	}{
+		{"users", "USERS", `{"name":"bob","passwordhash":"x","newpassword":"y"}`, []string{"passwordhash", "newpassword"}, []string{"name"}},
+		{"users lowercase", "users", `{"name":"bob","passwordhash":"x"}`, []string{"passwordhash"}, []string{"name"}},
+		{"other bucket", "INCIDENTS", `{"name":"fire","passwordhash":"x"}`, nil, []string{"name", "passwordhash"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := gabs.ParseJSON(Redact(test.bucketname, []byte(test.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range test.removed {
+				if parsed.Exists(field) {
+					t.Fatal(field, parsed.String())
+				}
+			}
+			for _, field := range test.kept {
+				if !parsed.Exists(field) {
+					t.Fatal(field, parsed.String())
+				}
+			}
+		})
+	}
+
+	// an object that can't be redacted is not sent
+	if data := Redact("USERS", []byte(`{"passwordhash":`)); data != nil {
+		t.Fatal(string(data))
+	}
+}
+
+func TestBroadcastRedacted(t *testing.T) {
+
+	grant := stubRights(t)
+	grant("ann", "USERS-read", true)
+
+	h := newTestHub()
+	ann := newTestClient(h, "ann")
+	h.updateSubscription(&tSubscription{client: ann, bucketname: "USERS", register: true, filter: &tRegistration{}})
+	ann.rememberRead("USERS")
+
+	h.send(&TBroadcast{Bucketname: "USERS", ID: "1", Message: []byte(`{"action":"UPDATE","name":"bob","passwordhash":"x","newpassword":"y"}`)})
+
+	messages := received(ann)
+	if len(messages) != 1 || strings.Contains(messages[0], "password") || !strings.Contains(messages[0], `"bob"`) {
+		t.Fatal(messages)
+	}
+}
+
+func TestRevokedRight(t *testing.T) {
+
+	grant := stubRights(t)
+	grant("bob", "INCIDENTS-read", true)
+
+	h := newTestHub()
+	bob := newTestClient(h, "bob")
+	h.updateSubscription(&tSubscription{client: bob, bucketname: "INCIDENTS", register: true, filter: &tRegistration{}})
+	h.updateWatch(&tWatch{client: bob, bucketname: "INCIDENTS", ids: []string{"2"}, register: true})
+	bob.rememberRead("INCIDENTS")
+
+	broadcast := func(id string) *TBroadcast {
+		return &TBroadcast{Bucketname: "INCIDENTS", ID: id, Message: []byte(`{"action":"INSERT","$id":"` + id + `"}`)}
+	}
+
+	h.send(broadcast("1"))
+	if messages := received(bob); len(messages) != 1 {
+		t.Fatal(messages)
+	}
+
+	// the right kept is use until the cache is refreshed
+	grant("bob", "INCIDENTS-read", false)
+	h.send(broadcast("1"))
+	if messages := received(bob); len(messages) != 1 {
+		t.Fatal(messages)
+	}
+
+	// once refreshed the broadcasts of the bucket and of the objects watched stop
+	RefreshRightsCache()
+	h.send(broadcast("1"))
+	h.send(broadcast("2"))
+	if messages := received(bob); len(messages) != 0 {
+		t.Fatal(messages)
+	}
+
+	// and start again when the right is granted back
+	grant("bob", "INCIDENTS-read", true)
+	RefreshRightsCache()
+	h.send(broadcast("2"))
+	if messages := received(bob); len(messages) != 1 {
+		t.Fatal(messages)
+	}
+}
@@ -68,6 +68,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"strconv"
 
 	"github.com/Jeffail/gabs"
 	"github.com/antigloss/go/logger"
@@ -149,7 +150,7 @@ func DBLogin(packet *MsgClientCmd) ([]byte, error) {
 		logger.Warn(err.Error())
 
 		// Send Response to user!
-		return []byte("{ \"action\":\"login\", \"result\":\"failed\", \"username\":\"" + packet.Username + "\"" + ", \"error\":\"" + err.Error() + "\"}"), err
+		return []byte("{ \"action\":\"login\", \"result\":\"failed\", \"username\":\"" + packet.Username + "\"" + ", \"version\":" + strconv.Itoa(ProtocolVersion) + ", \"error\":\"" + err.Error() + "\"}"), err
 
 	}
 
@@ -175,7 +176,7 @@ func DBLogin(packet *MsgClientCmd) ([]byte, error) {
 		logger.Info("User " + packet.Username + " as logged in")
 
 		// sucessfull login sent the good news to the user.
-		return []byte("{ \"action\":\"login\", \"result\":\"success\", \"settings\":" + settings + ", \"rights\":" + rights + ", \"username\":\"" + packet.Username + "\"}"), nil
+		return []byte("{ \"action\":\"login\", \"result\":\"success\", \"settings\":" + settings + ", \"rights\":" + rights + ", \"username\":\"" + packet.Username + "\", \"version\":" + strconv.Itoa(ProtocolVersion) + "}"), nil
 	}
 
 	/* this is an internal error, if verifypassword is successfull but can't find user... */
@@ -498,32 +499,17 @@ func VerifyUserHasRight(username []byte, rightname string) error {
 
 	// call postgre function UserAccess "select UserAccess ('username', 'name of right');" return 1 if has right else 0
 
-	sqlquery := "select ecureuil.UserAccess ('" + string(username) + "', '" + rightname + "');"
-
-	logger.Trace(sqlquery)
-
-	rows, err := sqldb.Query(sqlquery)
-
-	defer rows.Close()
+	logger.Trace("select ecureuil.UserAccess (" + string(username) + ", " + rightname + ");")
 
+	data := 0
+	err := sqldb.QueryRow("select ecureuil.UserAccess ($1, $2);", string(username), rightname).Scan(&data)
 	if err != nil {
+		logger.Error(err.Error())
 		return err
 	}
 
-	for rows.Next() {
-
-		data := 0
-		err = rows.Scan(&data)
-
-		if err != nil {
-			logger.Error(err.Error())
-			return err
-		}
-
-		if data == 1 {
-			return nil
-		}
-		break
+	if data == 1 {
+		return nil
 	}
 
 	return errors.New("User " + string(username) + " does not have access to " + rightname)
@@ -0,0 +1,77 @@
+/*
+
+This file build the TLS configuration used to connect to the server. The
+certificate of the server is always verified unless InsecureSkipVerify is set
+in the Options, a certificate can also be pinned by the SHA-256 of its public
+key.
+
+*/
+
+package jsonbarn
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+/*ErrPinnedKey is returned when the public key of the server certificate does
+not match any of Options.PinnedKeys.
+*/
+var ErrPinnedKey = errors.New("PinnedKeyMismatch")
+
+/*PublicKeyPin return the value to put in Options.PinnedKeys for a certificate.
+ */
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+/* tlsConfig return the TLS configuration of the dialer.
+ */
+func (opts *Options) tlsConfig() (*tls.Config, error) {
+
+	config := &tls.Config{}
+	if opts.TLSConfig != nil {
+		config = opts.TLSConfig.Clone()
+	}
+
+	// skipping the verification must be asked with the option
+	if config.InsecureSkipVerify && !opts.InsecureSkipVerify {
+		return nil, errors.New("InsecureSkipVerify is set in TLSConfig, set Options.InsecureSkipVerify to allow it")
+	}
+	if opts.InsecureSkipVerify {
+		opts.warnInsecure("jsonbarn: the certificate of the server will not be verified")
+		config.InsecureSkipVerify = true
+	}
+
+	if opts.RootCAs != nil {
+		config.RootCAs = opts.RootCAs
+	}
+	config.Certificates = append(config.Certificates, opts.ClientCertificates...)
+
+	if len(opts.PinnedKeys) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range opts.PinnedKeys {
+			pins[pin] = true
+		}
+		verify := config.VerifyConnection
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || !pins[PublicKeyPin(state.PeerCertificates[0])] {
+				return ErrPinnedKey
+			}
+			if verify != nil {
+				return verify(state)
+			}
+			return nil
+		}
+	}
+
+	if opts.AllowInsecureWS {
+		opts.warnInsecure("jsonbarn: connecting with ws://, the connection is not encrypted")
+	}
+
+	return config, nil
+}
@@ -0,0 +1,58 @@
+package jsonbarn
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+/* warnings is a Logger that keep the warnings. */
+type warnings []string
+
+func (w *warnings) Debug(msg string, args ...any) {}
+func (w *warnings) Info(msg string, args ...any)  {}
+func (w *warnings) Warn(msg string, args ...any)  { *w = append(*w, msg) }
+func (w *warnings) Error(msg string, args ...any) {}
+
+func TestInsecureWarning(t *testing.T) {
+
+	output := &bytes.Buffer{}
+	insecureOutput = output
+	defer func() { insecureOutput = os.Stderr }()
+
+	// without Logger the warnings are written to stderr
+	opts := Options{Host: "example.com", InsecureSkipVerify: true, AllowInsecureWS: true}
+	if _, err := opts.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for _, warning := range []string{"will not be verified", "not encrypted"} {
+		if !strings.Contains(output.String(), warning) {
+			t.Fatal("no warning", warning, output.String())
+		}
+	}
+	if !strings.Contains(output.String(), "host=example.com") {
+		t.Fatal(output.String())
+	}
+
+	// with a Logger they are logged instead
+	output.Reset()
+	logged := &warnings{}
+	opts = Options{Host: "example.com", AllowInsecureWS: true, Logger: logged}
+	if _, err := opts.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*logged) != 1 || output.Len() != 0 {
+		t.Fatal(*logged, output.String())
+	}
+
+	// a secure connection is not reported
+	output.Reset()
+	opts = Options{Host: "example.com"}
+	if _, err := opts.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if output.Len() != 0 {
+		t.Fatal(output.String())
+	}
+}